@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+	// The ustar magic is 257 bytes into the first header of a tar archive.
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+)
+
+// DetectCompression returns "gzip", "zstd", "bzip2" or "tar" when the first
+// bytes of a file are the magic bytes of one, or an empty string otherwise.
+func DetectCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(head, zstdMagic):
+		return "zstd"
+	case bytes.HasPrefix(head, bzip2Magic):
+		return "bzip2"
+	case len(head) >= tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return "tar"
+	}
+	return ""
+}
+
+// NewLogReader reads the logs in r, decompressing gzip, zstd and bzip2 and
+// reading every file of a tar archive one after the other, nested as deep as
+// they come, ie: a .tar.gz of .log.gz files. Anything else is read as it is.
+func NewLogReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	head, _ := buffered.Peek(tarMagicOffset + len(tarMagic))
+
+	var decompressed io.ReadCloser
+	var err error
+
+	switch DetectCompression(head) {
+	case "gzip":
+		decompressed, err = gzip.NewReader(buffered)
+	case "zstd":
+		decompressed, err = zstdReader(buffered)
+	case "bzip2":
+		decompressed = &readCloser{Reader: bzip2.NewReader(buffered)}
+	case "tar":
+		return &tarLogReader{tar: tar.NewReader(buffered)}, nil
+	default:
+		return &readCloser{Reader: buffered}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A compressed file can hold a tar archive, or another compressed file.
+	inner, err := NewLogReader(decompressed)
+	if err != nil {
+		decompressed.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: inner, closers: []io.Closer{inner, decompressed}}, nil
+}
+
+// readCloser closes whatever its reader reads from.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (self *readCloser) Close() error {
+	var err error
+	for _, closer := range self.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// tarLogReader reads the regular files of a tar archive one after the other,
+// making sure each one ends with a newline so their lines are not joined.
+type tarLogReader struct {
+	tar            *tar.Reader
+	current        io.ReadCloser
+	lastByte       byte
+	pendingNewline bool
+}
+
+func (self *tarLogReader) Read(p []byte) (int, error) {
+	for {
+		if self.pendingNewline && len(p) > 0 {
+			self.pendingNewline = false
+			p[0] = '\n'
+			return 1, nil
+		}
+
+		if self.current == nil {
+			header, err := self.tar.Next()
+			if err != nil {
+				return 0, err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			self.current, err = NewLogReader(self.tar)
+			if err != nil {
+				return 0, err
+			}
+			self.lastByte = '\n'
+		}
+
+		n, err := self.current.Read(p)
+		if n > 0 {
+			self.lastByte = p[n-1]
+		}
+		if err == io.EOF {
+			self.current.Close()
+			self.current = nil
+			self.pendingNewline = self.lastByte != '\n'
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (self *tarLogReader) Close() error {
+	if self.current != nil {
+		return self.current.Close()
+	}
+	return nil
+}
+
+// zstdReader decompresses with the zstd command, there is no zstd package in
+// the standard library.
+func zstdReader(reader io.Reader) (io.ReadCloser, error) {
+	c := exec.Command("zstd", "-dc")
+	c.Stdin = reader
+	c.Stderr = os.Stderr
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &commandReader{ReadCloser: stdout, cmd: c}, nil
+}
+
+// commandReader reads the output of a command and waits for it on Close.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (self *commandReader) Close() error {
+	self.ReadCloser.Close()
+	return self.cmd.Wait()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(b []byte) []byte {
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write(b)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func tarBytes(files map[string][]byte, order []string) []byte {
+	archive := new(bytes.Buffer)
+	writer := tar.NewWriter(archive)
+	writer.WriteHeader(&tar.Header{Name: "logs/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, name := range order {
+		writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+		writer.Write(files[name])
+	}
+	writer.Close()
+	return archive.Bytes()
+}
+
+func readLogs(t *testing.T, b []byte) string {
+	reader, err := NewLogReader(bytes.NewReader(b))
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	logs, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(logs)
+}
+
+func TestDetectCompression(t *testing.T) {
+	assert.Equal(t, "gzip", DetectCompression(gzipBytes([]byte("hello"))))
+	assert.Equal(t, "bzip2", DetectCompression([]byte("BZh91AY&SY")))
+	assert.Equal(t, "zstd", DetectCompression([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}))
+	assert.Equal(t, "tar", DetectCompression(tarBytes(map[string][]byte{"a.log": []byte("a")}, []string{"a.log"})))
+	assert.Equal(t, "", DetectCompression([]byte("2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  hello")))
+	assert.Equal(t, "", DetectCompression(nil))
+}
+
+func TestNewLogReader_Plain(t *testing.T) {
+	assert.Equal(t, "first\nsecond\n", readLogs(t, []byte("first\nsecond\n")))
+}
+
+func TestNewLogReader_Gzip(t *testing.T) {
+	assert.Equal(t, "first\nsecond\n", readLogs(t, gzipBytes([]byte("first\nsecond\n"))))
+}
+
+func TestNewLogReader_Bzip2(t *testing.T) {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		t.Skip("bzip2 is not installed")
+	}
+
+	cmd := exec.Command("bzip2", "-c")
+	cmd.Stdin = bytes.NewReader([]byte("first\nsecond\n"))
+	compressed, err := cmd.Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", readLogs(t, compressed))
+}
+
+func TestNewLogReader_Zstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	cmd := exec.Command("zstd", "-c")
+	cmd.Stdin = bytes.NewReader([]byte("first\nsecond\n"))
+	compressed, err := cmd.Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", readLogs(t, compressed))
+}
+
+func TestNewLogReader_TarGzOfGzippedLogs(t *testing.T) {
+	archive := tarBytes(map[string][]byte{
+		"logs/postgresql-1.log.gz": gzipBytes([]byte("first\nsecond")),
+		"logs/postgresql-2.log":    []byte("third\n"),
+	}, []string{"logs/postgresql-1.log.gz", "logs/postgresql-2.log"})
+
+	// The first file does not end with a newline, so one is added.
+	assert.Equal(t, "first\nsecond\nthird\n", readLogs(t, gzipBytes(archive)))
+}
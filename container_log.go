@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ie: "/var/log/pods/default_postgres-0_5f8c.../postgres/0.log"
+	RegexCRIPodLogPath = regexp.MustCompile(`/pods/([^/_]+)_([^/_]+)_([^/_]+)/([^/]+)/\d+\.log$`)
+	// ie: "/var/log/containers/postgres-0_default_postgres-0123abcd....log"
+	RegexCRIContainerLogPath = regexp.MustCompile(`/containers/([^/_]+)_([^/_]+)_(.+)-([0-9a-f]{64})\.log$`)
+	// ie: "/var/lib/docker/containers/0123abcd.../0123abcd...-json.log"
+	RegexDockerLogPath = regexp.MustCompile(`/containers/([0-9a-f]{64})/[^/]+-json\.log$`)
+	// ie: "2021-02-19T15:04:05.123456789Z stderr F message"
+	RegexCRILogLine = regexp.MustCompile(`^(\S+) (stdout|stderr) ([PF])(?: (.*))?$`)
+)
+
+// PathLogScanner is a LogScanner that reads from several files and can tell
+// which one the last scanned line came from.
+type PathLogScanner interface {
+	LogScanner
+	Path() string
+}
+
+// DockerLogLine is a line written by docker's json-file logging driver.
+type DockerLogLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// ContainerLogScanner reads the postgres logs out of the files container
+// runtimes write, in docker's json-file format or the CRI format of the files
+// under /var/log/pods. Lines the runtime split in parts are joined again, and
+// the pod and container are taken from the path of each file.
+type ContainerLogScanner struct {
+	scanner PathLogScanner
+
+	// The partial line of each file, waiting for the rest of it.
+	partials map[string]string
+	record   *LogRecord
+}
+
+func NewContainerLogScanner(scanner PathLogScanner) *ContainerLogScanner {
+	return &ContainerLogScanner{
+		scanner:  scanner,
+		partials: make(map[string]string),
+	}
+}
+
+func (self *ContainerLogScanner) Scan() bool {
+	for self.scanner.Scan() {
+		path := self.scanner.Path()
+		text, partial := unwrapContainerLogLine(self.scanner.Text())
+
+		text = self.partials[path] + text
+		if partial {
+			self.partials[path] = text
+			continue
+		}
+		delete(self.partials, path)
+
+		self.record = &LogRecord{
+			Text:   text,
+			Source: containerMetadata(path),
+		}
+		if recordScanner, ok := self.scanner.(RecordLogScanner); ok {
+			self.record.Cursor = recordScanner.Record().Cursor
+		}
+		return true
+	}
+	return false
+}
+
+func (self *ContainerLogScanner) Text() string {
+	return self.record.Text
+}
+
+func (self *ContainerLogScanner) Record() *LogRecord {
+	return self.record
+}
+
+func (self *ContainerLogScanner) Err() error {
+	return self.scanner.Err()
+}
+
+// unwrapContainerLogLine returns the line a container logged, and whether it is
+// only a part of it. Lines in neither format are returned as they are.
+func unwrapContainerLogLine(line string) (string, bool) {
+	if strings.HasPrefix(line, "{") {
+		dockerLine := new(DockerLogLine)
+		if err := json.Unmarshal([]byte(line), dockerLine); err == nil {
+			// Docker splits long lines, only the last part ends with a newline.
+			if strings.HasSuffix(dockerLine.Log, "\n") {
+				return strings.TrimRight(dockerLine.Log, "\r\n"), false
+			}
+			return dockerLine.Log, true
+		}
+	}
+
+	if match := RegexCRILogLine.FindStringSubmatch(line); match != nil {
+		return match[4], match[3] == "P"
+	}
+
+	return line, false
+}
+
+// containerMetadata labels the lines of a file with the pod and container in
+// its path, when the path is one that container runtimes use.
+func containerMetadata(path string) *SourceMetadata {
+	path = filepath.ToSlash(path)
+
+	if match := RegexCRIPodLogPath.FindStringSubmatch(path); match != nil {
+		return &SourceMetadata{Namespace: match[1], Pod: match[2], PodUID: match[3], Container: match[4]}
+	}
+	if match := RegexCRIContainerLogPath.FindStringSubmatch(path); match != nil {
+		return &SourceMetadata{Pod: match[1], Namespace: match[2], Container: match[3], ContainerID: match[4]}
+	}
+	if match := RegexDockerLogPath.FindStringSubmatch(path); match != nil {
+		return &SourceMetadata{ContainerID: match[1]}
+	}
+	return nil
+}
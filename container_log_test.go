@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePathLogScanner returns lines as if they were read from several files.
+type fakePathLogScanner struct {
+	paths []string
+	lines []string
+	index int
+}
+
+func (self *fakePathLogScanner) Scan() bool {
+	if self.index >= len(self.lines) {
+		return false
+	}
+	self.index++
+	return true
+}
+
+func (self *fakePathLogScanner) Text() string {
+	return self.lines[self.index-1]
+}
+
+func (self *fakePathLogScanner) Path() string {
+	return self.paths[self.index-1]
+}
+
+func (self *fakePathLogScanner) Err() error {
+	return nil
+}
+
+const (
+	testContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testPodLogPath  = "/var/log/pods/default_postgres-0_5f8c2a1e-1111-2222-3333-444455556666/postgres/0.log"
+)
+
+func TestUnwrapContainerLogLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		text    string
+		partial bool
+	}{
+		{`{"log":"SELECT 1\n","stream":"stderr","time":"2021-02-19T15:04:05.123456789Z"}`, "SELECT 1", false},
+		{`{"log":"SELECT ","stream":"stderr","time":"2021-02-19T15:04:05.123456789Z"}`, "SELECT ", true},
+		{"2021-02-19T15:04:05.123456789Z stderr F SELECT 1", "SELECT 1", false},
+		{"2021-02-19T15:04:05.123456789Z stderr P SELECT ", "SELECT ", true},
+		{"2021-02-19T15:04:05.123456789Z stdout F", "", false},
+		{"2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  SELECT 1", "2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  SELECT 1", false},
+	}
+
+	for _, test := range tests {
+		text, partial := unwrapContainerLogLine(test.line)
+		assert.Equal(t, test.text, text, test.line)
+		assert.Equal(t, test.partial, partial, test.line)
+	}
+}
+
+func TestContainerMetadata(t *testing.T) {
+	assert.Equal(t, &SourceMetadata{
+		Namespace: "default",
+		Pod:       "postgres-0",
+		PodUID:    "5f8c2a1e-1111-2222-3333-444455556666",
+		Container: "postgres",
+	}, containerMetadata(testPodLogPath))
+
+	assert.Equal(t, &SourceMetadata{
+		Namespace:   "default",
+		Pod:         "postgres-0",
+		Container:   "postgres",
+		ContainerID: testContainerID,
+	}, containerMetadata("/var/log/containers/postgres-0_default_postgres-"+testContainerID+".log"))
+
+	assert.Equal(t, &SourceMetadata{
+		ContainerID: testContainerID,
+	}, containerMetadata("/var/lib/docker/containers/"+testContainerID+"/"+testContainerID+"-json.log"))
+
+	assert.Nil(t, containerMetadata("/var/log/postgresql/postgresql-14-main.log"))
+}
+
+func TestContainerLogScanner_JoinsPartialLinesPerFile(t *testing.T) {
+	dockerPath := "/var/lib/docker/containers/" + testContainerID + "/" + testContainerID + "-json.log"
+	scanner := NewContainerLogScanner(&fakePathLogScanner{
+		paths: []string{testPodLogPath, dockerPath, testPodLogPath, dockerPath, testPodLogPath},
+		lines: []string{
+			"2021-02-19T15:04:05.1Z stderr P SELECT ",
+			`{"log":"UPDATE ","stream":"stderr","time":"2021-02-19T15:04:05.2Z"}`,
+			"2021-02-19T15:04:05.3Z stderr F 1",
+			`{"log":"accounts\n","stream":"stderr","time":"2021-02-19T15:04:05.4Z"}`,
+			"2021-02-19T15:04:05.5Z stderr F SELECT 2",
+		},
+	})
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "SELECT 1", scanner.Text())
+	assert.Equal(t, "postgres-0", scanner.Record().Source.Pod)
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "UPDATE accounts", scanner.Text())
+	assert.Equal(t, testContainerID, scanner.Record().Source.ContainerID)
+
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "SELECT 2", scanner.Text())
+
+	assert.False(t, scanner.Scan())
+	assert.Nil(t, scanner.Err())
+}
+
+func TestPostgresLogParser_ContainerMetadata(t *testing.T) {
+	scanner := NewContainerLogScanner(&fakePathLogScanner{
+		paths: []string{testPodLogPath, testPodLogPath, testPodLogPath},
+		lines: []string{
+			"2021-02-19T15:04:05.1Z stderr F 2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  temporary file: path \"base/pgsql_tmp/pgsql_tmp56193.0\", size 1024",
+			"2021-02-19T15:04:05.2Z stderr F 2021-02-19 15:04:05 UTC [56193-3/9939-5707] app@ledger STATEMENT:  SELECT 1",
+			"2021-02-19T15:04:05.3Z stderr F 2021-02-19 15:04:06 UTC [56193-3/9939-5708] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 1",
+		},
+	})
+	parser := NewPostgresLogParser(scanner)
+
+	logLine, err := parser.Parse()
+	assert.Nil(t, err)
+	b, err := json.Marshal(ParseTempFile(logLine))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"namespace":"default","pod":"postgres-0","pod_uid":"5f8c2a1e-1111-2222-3333-444455556666","container":"postgres"`)
+}
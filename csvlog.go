@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// The columns written by log_destination = csvlog. Postgres 13 added
+// backend_type and postgres 14 added leader_pid and query_id, so older
+// servers write fewer columns.
+const (
+	csvLogTime = iota
+	csvUserName
+	csvDatabaseName
+	csvProcessID
+	csvConnectionFrom
+	csvSessionID
+	csvSessionLineNum
+	csvCommandTag
+	csvSessionStartTime
+	csvVirtualTransactionID
+	csvTransactionID
+	csvErrorSeverity
+	csvSQLStateCode
+	csvMessage
+	csvDetail
+	csvHint
+	csvInternalQuery
+	csvInternalQueryPos
+	csvContext
+	csvQuery
+	csvQueryPos
+	csvLocation
+	csvApplicationName
+	csvBackendType
+	csvLeaderPID
+	csvQueryID
+)
+
+// CSVLogParser reads postgres csvlog records. Unlike the stderr format, every
+// record is complete when it is read, so no timer is needed to detect the end
+// of a multi-line statement.
+type CSVLogParser struct {
+	reader *csv.Reader
+
+	// The scanner the records are read from, when it knows the cursor of each
+	// line.
+	recordScanner RecordLogScanner
+}
+
+func NewCSVLogParser(r io.Reader) *CSVLogParser {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	parser := &CSVLogParser{
+		reader: reader,
+	}
+	if scannerReader, ok := r.(*logScannerReader); ok {
+		parser.recordScanner, _ = scannerReader.scanner.(RecordLogScanner)
+	}
+	return parser
+}
+
+func (self *CSVLogParser) Parse() (*PostgresLogLine, error) {
+	record, err := self.reader.Read()
+	if err == io.EOF {
+		return nil, ErrLogEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log := parseCSVLogRecord(record)
+	if self.recordScanner != nil {
+		// The reader hands out a line at a time, so the last line scanned is
+		// the last line of the record.
+		log.Cursor = self.recordScanner.Record().Cursor
+	}
+	err = parseMessage(log)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func parseCSVLogRecord(record []string) *PostgresLogLine {
+	column := func(index int) string {
+		if index < len(record) {
+			return record[index]
+		}
+		return ""
+	}
+
+	log := &PostgresLogLine{
+		Timestamp:            parsePrefixTime(column(csvLogTime)),
+		Username:             column(csvUserName),
+		Database:             column(csvDatabaseName),
+		SessionID:            column(csvSessionID),
+		CommandTag:           column(csvCommandTag),
+		VirtualTransactionID: column(csvVirtualTransactionID),
+		TransactionID:        column(csvTransactionID),
+		Severity:             column(csvErrorSeverity),
+		SQLState:             column(csvSQLStateCode),
+		Message:              column(csvMessage),
+		Detail:               column(csvDetail),
+		Hint:                 column(csvHint),
+		Context:              column(csvContext),
+		Statement:            column(csvQuery),
+		ApplicationName:      column(csvApplicationName),
+		BackendType:          column(csvBackendType),
+		QueryID:              column(csvQueryID),
+	}
+	log.PID, _ = strconv.Atoi(column(csvProcessID))
+	log.LineNumber, _ = strconv.Atoi(column(csvSessionLineNum))
+	log.QueryPosition, _ = strconv.Atoi(column(csvQueryPos))
+	log.RemoteHost, log.RemotePort = splitConnectionFrom(column(csvConnectionFrom))
+
+	return log
+}
+
+// connection_from is either "host:port" or "[local]" for unix sockets. IPv6
+// hosts are not bracketed, so split on the last colon.
+func splitConnectionFrom(connectionFrom string) (string, string) {
+	index := strings.LastIndex(connectionFrom, ":")
+	if index < 0 {
+		return connectionFrom, ""
+	}
+	port := connectionFrom[index+1:]
+	if _, err := strconv.Atoi(port); err != nil {
+		return connectionFrom, ""
+	}
+	return connectionFrom[:index], port
+}
+
+// logScannerReader turns the lines of a LogScanner back into a stream so it can
+// be read by parsers that do their own framing, like encoding/csv.
+type logScannerReader struct {
+	scanner LogScanner
+	pending []byte
+	stopped bool
+}
+
+func NewLogScannerReader(scanner LogScanner) io.Reader {
+	return &logScannerReader{scanner: scanner}
+}
+
+// Read ends the stream once the scanner stops, even on an error, like a line
+// that is too long, which the scanner would otherwise be stuck on.
+func (self *logScannerReader) Read(p []byte) (int, error) {
+	for len(self.pending) == 0 {
+		if self.stopped {
+			return 0, io.EOF
+		}
+		if !self.scanner.Scan() {
+			self.stopped = true
+			if err := self.scanner.Err(); err != nil {
+				log.Println("Could not read the csvlog:", err)
+			}
+			return 0, io.EOF
+		}
+		self.pending = []byte(self.scanner.Text() + "\n")
+	}
+
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
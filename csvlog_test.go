@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVLogParser_MultilineStatement(t *testing.T) {
+	log := `2021-02-08 16:09:20.123 UTC,"postgres","bob1989_production",26820,"10.1.2.3:51234",60216f40.68c4,3,"SELECT",2021-02-08 16:00:00 UTC,153/0,0,LOG,00000,"duration: 2723.044 ms  statement: WITH all_sequences AS (
+         SELECT  pg_namespace.nspname as namespace
+         FROM pg_attribute
+         WHERE pg_class.relname = 'users'
+)",,,,,,,,,"psql","client backend",,-4411283745215862466
+2021-02-08 16:09:21.000 UTC,"postgres","bob1989_production",26820,"10.1.2.3:51234",60216f40.68c4,4,"SELECT",2021-02-08 16:00:00 UTC,153/0,0,LOG,00000,"duration: 0.020 ms  execute <unnamed>: SELECT ""users"".* FROM ""users"" WHERE id = $1",,,,,,,,,"psql","client backend",,0
+`
+
+	logParser := NewCSVLogParser(strings.NewReader(log))
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "statement", pgLog.LogType)
+	assert.Equal(t, "", pgLog.StatementName)
+	assert.Equal(t, time.Duration(2723044000), pgLog.Duration)
+	assert.Equal(t, "postgres", pgLog.Username)
+	assert.Equal(t, "bob1989_production", pgLog.Database)
+	assert.Equal(t, 26820, pgLog.PID)
+	assert.Equal(t, 3, pgLog.LineNumber)
+	assert.Equal(t, "10.1.2.3", pgLog.RemoteHost)
+	assert.Equal(t, "51234", pgLog.RemotePort)
+	assert.Equal(t, "60216f40.68c4", pgLog.SessionID)
+	assert.Equal(t, "psql", pgLog.ApplicationName)
+	assert.Equal(t, "00000", pgLog.SQLState)
+	assert.Equal(t, "-4411283745215862466", pgLog.QueryID)
+	assert.Equal(t, 123*time.Millisecond, time.Duration(pgLog.Timestamp.Nanosecond()))
+	assert.True(t, strings.HasSuffix(pgLog.Value, "WHERE pg_class.relname = 'users'\n)"))
+
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "execute", pgLog.LogType)
+	assert.Equal(t, "<unnamed>", pgLog.StatementName)
+	assert.Equal(t, `SELECT "users".* FROM "users" WHERE id = $1`, pgLog.Value)
+
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
+
+func TestCSVLogParser_OlderServerAndNonDurationRecord(t *testing.T) {
+	// Postgres 12 writes 23 columns and no backend_type.
+	log := `2021-01-06 18:10:48.000 EST,,,835970,,5ff64328.cc1a2,1,,2021-01-06 18:10:48 EST,,0,LOG,00000,"database system is ready to accept connections",,,,,,,,,""
+2021-01-06 18:10:55.000 EST,"testuser","dispatch_development",835986,"[local]",5ff6432f.cc1b2,1,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 3002.016 ms  statement: select pg_sleep(3);",,,,,,,,,"psql"
+`
+
+	logParser := NewCSVLogParser(strings.NewReader(log))
+	_, err := logParser.Parse()
+	assert.Equal(t, ErrInvalidLogLine, err)
+
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "[local]", pgLog.RemoteHost)
+	assert.Equal(t, "", pgLog.RemotePort)
+	assert.Equal(t, "", pgLog.BackendType)
+	assert.Equal(t, "select pg_sleep(3);", pgLog.Value)
+}
+
+func TestCSVLogParser_FromLogScanner(t *testing.T) {
+	log := `2021-01-06 18:10:55.000 EST,"testuser","dispatch_development",835986,"::1:5432",5ff6432f.cc1b2,2,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 3002.900 ms  statement: SELECT 1, 2,
+	pg_sleep(3);",,,,,,,,,"psql"
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewCSVLogParser(NewLogScannerReader(scanner))
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "::1", pgLog.RemoteHost)
+	assert.Equal(t, "5432", pgLog.RemotePort)
+	assert.Equal(t, "SELECT 1, 2,\n\tpg_sleep(3);", pgLog.Value)
+
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
+
+func TestCSVLogParser_RecordTooLong(t *testing.T) {
+	log := `2021-01-06 18:10:55.000 EST,"testuser","dispatch_development",835986,"::1:5432",5ff6432f.cc1b2,2,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 1.000 ms  statement: SELECT 1",,,,,,,,,"psql"
+2021-01-06 18:10:56.000 EST,"testuser","dispatch_development",835986,"::1:5432",5ff6432f.cc1b2,3,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 1.000 ms  statement: SELECT '` + strings.Repeat("x", 70*1024) + `'",,,,,,,,,"psql"
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewCSVLogParser(NewLogScannerReader(scanner))
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT 1", pgLog.Value)
+
+	// The scanner gives up on the long line, which ends the log rather than
+	// failing every record after it.
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
+
+// numberedLogScanner gives each line its line number as its cursor.
+type numberedLogScanner struct {
+	*bufio.Scanner
+	line int
+}
+
+func (self *numberedLogScanner) Scan() bool {
+	self.line++
+	return self.Scanner.Scan()
+}
+
+func (self *numberedLogScanner) Record() *LogRecord {
+	return &LogRecord{Text: self.Text(), Cursor: strconv.Itoa(self.line)}
+}
+
+func TestCSVLogParser_Cursor(t *testing.T) {
+	log := `2021-01-06 18:10:55.000 EST,"testuser","dispatch_development",835986,"::1:5432",5ff6432f.cc1b2,2,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 3002.900 ms  statement: SELECT 1, 2,
+	pg_sleep(3);",,,,,,,,,"psql"
+2021-01-06 18:10:56.000 EST,"testuser","dispatch_development",835986,"::1:5432",5ff6432f.cc1b2,3,"SELECT",2021-01-06 18:10:50 EST,3/0,0,LOG,00000,"duration: 3002.900 ms  statement: SELECT 3",,,,,,,,,"psql"
+`
+
+	scanner := &numberedLogScanner{Scanner: bufio.NewScanner(strings.NewReader(log))}
+	logParser := NewCSVLogParser(NewLogScannerReader(scanner))
+
+	// A record has the cursor of its last line.
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "2", pgLog.Cursor)
+
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "3", pgLog.Cursor)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ElasticsearchOptions struct {
+	// The url of the cluster, ie: "https://elasticsearch:9200".
+	URL string
+	// The index of each document, with %Y, %m, %d and %H replaced by the date
+	// it was created at, in UTC.
+	IndexPattern string
+	// Basic auth, or an API key, which takes precedence.
+	Username string
+	Password string
+	APIKey   string
+	// A batch is sent once it has this many documents or bytes, or once the
+	// flush interval has passed. No request is larger than either, unless a
+	// single document is larger than BatchBytes.
+	BatchSize     int
+	BatchBytes    int
+	FlushInterval time.Duration
+	// How many times a document the cluster rejected is sent again, waiting
+	// RetryBackoff longer each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func DefaultElasticsearchOptions() ElasticsearchOptions {
+	return ElasticsearchOptions{
+		IndexPattern:  "timber-%Y.%m.%d",
+		BatchSize:     500,
+		BatchBytes:    5 * 1024 * 1024,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    3,
+		RetryBackoff:  time.Second,
+	}
+}
+
+// Set by flags for every elasticsearch and opensearch sink.
+var elasticsearchOptions = DefaultElasticsearchOptions()
+
+func init() {
+	factory := func(target string) (Sink, error) {
+		options := elasticsearchOptions
+		options.URL = target
+		return NewElasticsearchSink(options)
+	}
+	RegisterSink("elasticsearch", factory)
+	RegisterSink("opensearch", factory)
+}
+
+// FormatIndex replaces the %Y, %m, %d and %H of an index pattern with the
+// year, month, day and hour of t.
+func FormatIndex(pattern string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"%Y", fmt.Sprintf("%04d", t.Year()),
+		"%m", fmt.Sprintf("%02d", t.Month()),
+		"%d", fmt.Sprintf("%02d", t.Day()),
+		"%H", fmt.Sprintf("%02d", t.Hour()),
+		"%%", "%",
+	).Replace(pattern)
+}
+
+// bulkDocument is a message waiting to be indexed.
+type bulkDocument struct {
+	index   string
+	action  []byte
+	payload []byte
+}
+
+func newBulkDocument(index string, payload []byte) *bulkDocument {
+	action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": index}})
+	return &bulkDocument{index: index, action: action, payload: payload}
+}
+
+// size is how many bytes the document takes up in a _bulk request.
+func (self *bulkDocument) size() int {
+	return len(self.action) + len(self.payload) + 2
+}
+
+// bulkResponse is the part of a _bulk response that tells which documents
+// were rejected, in the order they were sent.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// ElasticsearchSink indexes messages straight into Elasticsearch or OpenSearch
+// with _bulk requests. Documents the cluster rejects because it is busy or
+// failing are sent again, those it rejects for good are logged and dropped.
+type ElasticsearchSink struct {
+	*batcher
+	options ElasticsearchOptions
+	client  *http.Client
+}
+
+func NewElasticsearchSink(options ElasticsearchOptions) (*ElasticsearchSink, error) {
+	if options.URL == "" {
+		return nil, errors.New("the elasticsearch sink needs a url, ie: elasticsearch:https://elasticsearch:9200")
+	}
+
+	defaults := DefaultElasticsearchOptions()
+	if options.IndexPattern == "" {
+		options.IndexPattern = defaults.IndexPattern
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	if options.BatchBytes <= 0 {
+		options.BatchBytes = defaults.BatchBytes
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaults.FlushInterval
+	}
+	options.URL = strings.TrimSuffix(options.URL, "/")
+
+	sink := &ElasticsearchSink{
+		options: options,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	sink.batcher = newBatcher("elasticsearch", batcherOptions{
+		BatchSize:     options.BatchSize,
+		BatchBytes:    options.BatchBytes,
+		FlushInterval: options.FlushInterval,
+		MaxRetries:    options.MaxRetries,
+		RetryBackoff:  options.RetryBackoff,
+	}, sink.send)
+	return sink, nil
+}
+
+func (self *ElasticsearchSink) Write(ctx context.Context, event *Event) error {
+	document := newBulkDocument(FormatIndex(self.options.IndexPattern, event.CreatedAt()), event.Payload)
+	return self.add(document, document.size())
+}
+
+// send makes a _bulk request and returns the documents worth sending again.
+func (self *ElasticsearchSink) send(documents []interface{}) ([]interface{}, error) {
+	batch := make([]*bulkDocument, len(documents))
+	for i, document := range documents {
+		batch[i] = document.(*bulkDocument)
+	}
+
+	var body bytes.Buffer
+	for _, document := range batch {
+		body.Write(document.action)
+		body.WriteByte('\n')
+		body.Write(document.payload)
+		body.WriteByte('\n')
+	}
+
+	request, err := http.NewRequest("POST", self.options.URL+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if self.options.APIKey != "" {
+		request.Header.Set("Authorization", "ApiKey "+self.options.APIKey)
+	} else if self.options.Username != "" {
+		request.SetBasicAuth(self.options.Username, self.options.Password)
+	}
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		return documents, err
+	}
+	defer response.Body.Close()
+
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return documents, err
+	}
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return documents, fmt.Errorf("elasticsearch responded with %s", response.Status)
+	}
+	if response.StatusCode >= 300 {
+		// The whole request was refused, sending it again would not help.
+		return nil, fmt.Errorf("elasticsearch responded with %s: %s", response.Status, b)
+	}
+
+	result := new(bulkResponse)
+	err = json.Unmarshal(b, result)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the elasticsearch response: %v", err)
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+
+	retry := []interface{}{}
+	for i, item := range result.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, status := range item {
+			switch {
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, batch[i])
+			case status.Status >= 300:
+				log.Printf("Elasticsearch rejected a message into %s: %s\n", batch[i].index, status.Error)
+			}
+		}
+	}
+	return retry, nil
+}
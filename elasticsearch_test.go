@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The answer to a _bulk request that indexed every document.
+var bulkIndexed = cannedResponse{http.StatusOK, `{"errors":false,"items":[]}`}
+
+func testEvent(t *testing.T, query string) *Event {
+	event, err := NewEvent(map[string]string{
+		"query":      query,
+		"created_at": "2021-02-19 15:04:05.123 +0000 UTC",
+		"type":       "timber.postgres_slow_query",
+	})
+	assert.Nil(t, err)
+	return event
+}
+
+func TestFormatIndex(t *testing.T) {
+	date := time.Date(2021, 2, 9, 5, 4, 5, 0, time.UTC)
+	assert.Equal(t, "timber-2021.02.09", FormatIndex("timber-%Y.%m.%d", date))
+	assert.Equal(t, "logs-2021-02-09-05-100%", FormatIndex("logs-%Y-%m-%d-%H-100%%", date))
+	assert.Equal(t, "timber", FormatIndex("timber", date))
+}
+
+func TestElasticsearchSink_SendsFullBatches(t *testing.T) {
+	server := newRecordingServer(bulkIndexed)
+	defer server.Close()
+
+	options := DefaultElasticsearchOptions()
+	options.URL = server.URL + "/"
+	options.APIKey = "c2VjcmV0"
+	options.BatchSize = 2
+	options.FlushInterval = time.Hour
+	sink, err := NewElasticsearchSink(options)
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, sink.Write(ctx, testEvent(t, "SELECT 1")))
+	assert.Nil(t, sink.Write(ctx, testEvent(t, "SELECT 2")))
+
+	// The full batch is sent without waiting for the flush interval.
+	var requests []*http.Request
+	var bodies [][]byte
+	for deadline := time.Now().Add(2 * time.Second); len(bodies) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		requests, bodies = server.received()
+	}
+	assert.Len(t, bodies, 1)
+	assert.Equal(t, `{"index":{"_index":"timber-2021.02.19"}}
+{"created_at":"2021-02-19 15:04:05.123 +0000 UTC","query":"SELECT 1","type":"timber.postgres_slow_query"}
+{"index":{"_index":"timber-2021.02.19"}}
+{"created_at":"2021-02-19 15:04:05.123 +0000 UTC","query":"SELECT 2","type":"timber.postgres_slow_query"}
+`, string(bodies[0]))
+	assert.Equal(t, "/_bulk", requests[0].URL.Path)
+	assert.Equal(t, "ApiKey c2VjcmV0", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "application/x-ndjson", requests[0].Header.Get("Content-Type"))
+}
+
+func TestElasticsearchSink_CutsRequestsAtBatchBytes(t *testing.T) {
+	server := newRecordingServer(bulkIndexed)
+	defer server.Close()
+
+	options := DefaultElasticsearchOptions()
+	options.URL = server.URL
+	options.FlushInterval = time.Hour
+	sink, err := NewElasticsearchSink(options)
+	assert.Nil(t, err)
+
+	// A backlog of large documents, like plans, is sent in requests of at
+	// most BatchBytes.
+	plan := strings.Repeat("x", 1000)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, sink.Write(ctx, testEvent(t, plan)))
+	}
+	sink.batcher.options.BatchBytes = 2500
+	assert.Nil(t, sink.Flush())
+
+	_, bodies := server.received()
+	assert.Len(t, bodies, 5)
+	for _, body := range bodies {
+		assert.True(t, len(body) <= sink.batcher.options.BatchBytes, "a request of %d bytes", len(body))
+		assert.Equal(t, 2, strings.Count(string(body), `"_index"`))
+	}
+
+	// A document larger than BatchBytes is still sent, on its own.
+	sink.batcher.options.BatchBytes = 100
+	assert.Nil(t, sink.Write(ctx, testEvent(t, plan)))
+	assert.Nil(t, sink.Write(ctx, testEvent(t, plan)))
+	assert.Nil(t, sink.Close())
+	_, bodies = server.received()
+	assert.Len(t, bodies, 7)
+}
+
+func TestElasticsearchSink_RetriesRejectedDocuments(t *testing.T) {
+	server := newRecordingServer(bulkIndexed, cannedResponse{http.StatusOK, `{"errors":true,"items":[
+		{"index":{"status":201}},
+		{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+		{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}
+	]}`})
+	defer server.Close()
+
+	options := DefaultElasticsearchOptions()
+	options.URL = server.URL
+	options.Username = "timber"
+	options.Password = "hunter2"
+	options.FlushInterval = time.Hour
+	options.RetryBackoff = time.Millisecond
+	sink, err := NewElasticsearchSink(options)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 3"} {
+		assert.Nil(t, sink.Write(ctx, testEvent(t, query)))
+	}
+	assert.Nil(t, sink.Flush())
+
+	// Only the document rejected with a 429 is sent again. The one that does
+	// not fit the mapping never will.
+	requests, bodies := server.received()
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, 3, strings.Count(string(bodies[0]), `"_index"`))
+	assert.Equal(t, 1, strings.Count(string(bodies[1]), `"_index"`))
+	assert.Contains(t, string(bodies[1]), "SELECT 2")
+
+	username, password, ok := requests[0].BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "timber", username)
+	assert.Equal(t, "hunter2", password)
+
+	// Nothing is left to send on close.
+	assert.Nil(t, sink.Close())
+	_, bodies = server.received()
+	assert.Len(t, bodies, 2)
+}
+
+func TestElasticsearchSink_GivesUpAfterRetries(t *testing.T) {
+	rejected := cannedResponse{http.StatusOK, `{"errors":true,"items":[{"index":{"status":503}}]}`}
+	server := newRecordingServer(bulkIndexed, rejected, rejected, rejected)
+	defer server.Close()
+
+	options := DefaultElasticsearchOptions()
+	options.URL = server.URL
+	options.MaxRetries = 2
+	options.RetryBackoff = 50 * time.Millisecond
+	options.FlushInterval = time.Hour
+	sink, err := NewElasticsearchSink(options)
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Write(context.Background(), testEvent(t, "SELECT 1")))
+	start := time.Now()
+	assert.Nil(t, sink.Close())
+
+	// The first attempt and two retries, 50ms and then 100ms later.
+	_, bodies := server.received()
+	assert.Len(t, bodies, 3)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestElasticsearchSink_URLRequired(t *testing.T) {
+	_, err := OpenSink("elasticsearch")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileLogScanner follows every file matching a path or glob, like `tail -F`.
+// It notices rename and truncate style rotation, picks up files created by the
+// log_filename pattern, and can save the offset of each file to a state file so
+// that a restart resumes where it stopped. The offset saved is the one of the
+// last line Processed, not the last line read, so entries that were read but
+// not yet sent are read again. Compressed files and tar archives are read once
+// from the beginning instead of followed.
+type FileLogScanner struct {
+	pattern      string
+	statePath    string
+	pollInterval time.Duration
+
+	// Guards the files and offsets, which Processed updates from the goroutine
+	// that sends the entries while Scan reads the next ones.
+	mutex        sync.Mutex
+	files        map[string]*tailedFile
+	offsets      map[string]fileOffset
+	lastID       int64
+	stateSavedAt time.Time
+	stopped      bool
+
+	// Reports whether a line starts a new entry, so a turn only ends between
+	// entries. Without it, a turn ends before any line that isn't indented.
+	startsEntry func(line string) bool
+
+	text      string
+	path      string
+	cursor    string
+	turnLines int
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type tailedFile struct {
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+
+	// A line read ahead by peekLine, which readLine returns next.
+	next    string
+	hasNext bool
+
+	// Identifies this file, and this file since it was last truncated, in the
+	// cursors of its lines. The offset of the last processed line is what the
+	// state file records.
+	id        int64
+	processed int64
+
+	// Set for compressed files and archives. They are read once their size
+	// stops changing, and done once read to the end.
+	archive bool
+	logs    io.ReadCloser
+	done    bool
+}
+
+// fileOffset is what the state file records for each path.
+type fileOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// How often the state file is written while lines are being read.
+const fileStateSaveInterval = time.Second
+
+// How many lines in a row are read from one file while the others have lines
+// waiting too.
+const fileLinesPerTurn = 1000
+
+// NewFileLogScanner starts following the files matching pattern. Files that
+// already exist are read from their saved offset, or from the end when there is
+// no saved offset. Files created later are read from the beginning.
+func NewFileLogScanner(pattern string, statePath string) (*FileLogScanner, error) {
+	// Check the pattern up front, Glob only reports a bad pattern.
+	if _, err := filepath.Glob(pattern); err != nil {
+		return nil, err
+	}
+
+	scanner := &FileLogScanner{
+		pattern:      pattern,
+		statePath:    statePath,
+		pollInterval: 250 * time.Millisecond,
+		files:        make(map[string]*tailedFile),
+		offsets:      make(map[string]fileOffset),
+		closed:       make(chan struct{}),
+	}
+
+	err := scanner.loadState()
+	if err != nil {
+		return nil, err
+	}
+	scanner.discoverFiles(true)
+
+	return scanner, nil
+}
+
+func (self *FileLogScanner) Scan() bool {
+	for {
+		select {
+		case <-self.closed:
+			self.stop()
+			return false
+		default:
+		}
+
+		if self.readNextLine() {
+			return true
+		}
+
+		self.mutex.Lock()
+		self.checkRotation()
+		self.discoverFiles(false)
+		self.mutex.Unlock()
+
+		select {
+		case <-self.closed:
+			self.stop()
+			return false
+		case <-time.After(self.pollInterval):
+		}
+	}
+}
+
+// readNextLine keeps reading the file the last line came from until it has no
+// more lines or fileLinesPerTurn were read from it, and then moves on to the
+// files after it, so one busy file doesn't keep the others from being read. A
+// turn is only over at the end of an entry, so the lines of an entry are never
+// split up by the lines of another file.
+func (self *FileLogScanner) readNextLine() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	paths := self.sortedPaths()
+	start := sort.SearchStrings(paths, self.path)
+	turnOver := start < len(paths) && paths[start] == self.path &&
+		self.turnLines >= fileLinesPerTurn && !self.continuesEntry(self.files[self.path])
+	if turnOver {
+		start++
+	}
+
+	for i := range paths {
+		path := paths[(start+i)%len(paths)]
+		tailed := self.files[path]
+		line, ok := tailed.readLine()
+		if ok {
+			if path != self.path || turnOver {
+				self.turnLines = 0
+			}
+			self.turnLines++
+			self.text = line
+			self.path = path
+			self.cursor = fmt.Sprintf("%d:%d", tailed.id, tailed.offset)
+			return true
+		}
+	}
+	return false
+}
+
+// continuesEntry reports whether the next line of a file, as far as it has been
+// written, belongs to the entry of the line before it, like a DETAIL line or the
+// rest of a multi-line query.
+func (self *FileLogScanner) continuesEntry(tailed *tailedFile) bool {
+	if self.startsEntry == nil {
+		return tailed.continued()
+	}
+	line, ok := tailed.peekLine()
+	return ok && !self.startsEntry(line)
+}
+
+func (self *FileLogScanner) Text() string {
+	return self.text
+}
+
+// Record returns the last scanned line along with its cursor, which is handed
+// back to Processed once its entry has been sent.
+func (self *FileLogScanner) Record() *LogRecord {
+	return &LogRecord{Text: self.text, Cursor: self.cursor}
+}
+
+// Path returns the path of the file the last scanned line came from.
+func (self *FileLogScanner) Path() string {
+	return self.path
+}
+
+func (self *FileLogScanner) Err() error {
+	return nil
+}
+
+// Close makes Scan save the offsets, close the files and return false. It is
+// safe to call from another goroutine.
+func (self *FileLogScanner) Close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+}
+
+// Processed records that the line with the cursor, and every line before it in
+// its file, has been sent, and saves the offsets at most once every
+// fileStateSaveInterval.
+func (self *FileLogScanner) Processed(cursor string) {
+	var id, offset int64
+	if _, err := fmt.Sscanf(cursor, "%d:%d", &id, &offset); err != nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, tailed := range self.files {
+		// Lines of a file that has since been rotated or truncated are ignored.
+		if tailed.id == id && offset > tailed.processed {
+			tailed.processed = offset
+		}
+	}
+	if time.Since(self.stateSavedAt) >= fileStateSaveInterval {
+		self.saveState()
+	}
+}
+
+// SaveState writes the offsets of the processed lines to the state file.
+func (self *FileLogScanner) SaveState() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.saveState()
+}
+
+// stop closes the files, but keeps track of them so the lines that were read
+// before can still be Processed.
+func (self *FileLogScanner) stop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.stopped {
+		return
+	}
+	self.stopped = true
+	self.saveState()
+	for _, tailed := range self.files {
+		tailed.close()
+	}
+}
+
+func (self *FileLogScanner) sortedPaths() []string {
+	paths := make([]string, 0, len(self.files))
+	for path := range self.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (self *FileLogScanner) discoverFiles(startup bool) {
+	paths, _ := filepath.Glob(self.pattern)
+	for _, path := range paths {
+		if _, ok := self.files[path]; ok {
+			continue
+		}
+
+		tailed, err := openTailedFile(path)
+		if err != nil {
+			log.Println("Could not open log file:", err)
+			continue
+		}
+
+		saved, ok := self.offsets[path]
+		switch {
+		case tailed.archive:
+			// Like plain files, archives that were there before are skipped.
+			sameFile := ok && saved.Inode == inode(tailed.info)
+			tailed.done = (sameFile && saved.Offset >= tailed.info.Size()) || (startup && !ok)
+			if tailed.done {
+				tailed.offset = tailed.info.Size()
+			}
+		case ok && saved.Inode == inode(tailed.info) && saved.Offset <= tailed.info.Size():
+			tailed.seek(saved.Offset)
+		case startup && !ok:
+			tailed.seek(tailed.info.Size())
+		}
+		self.track(path, tailed)
+	}
+}
+
+// track starts following a file from its current offset, with a new id so
+// cursors of lines read before are not mistaken for its own.
+func (self *FileLogScanner) track(path string, tailed *tailedFile) {
+	self.lastID++
+	tailed.id = self.lastID
+	tailed.processed = tailed.offset
+	self.files[path] = tailed
+}
+
+// checkRotation reopens files that were renamed or removed from under us once
+// the old file has been read to the end, and rewinds files that were truncated.
+func (self *FileLogScanner) checkRotation() {
+	for path, tailed := range self.files {
+		current, err := tailed.file.Stat()
+		if err != nil {
+			continue
+		}
+
+		if tailed.archive && !tailed.done {
+			continue
+		}
+
+		if !tailed.archive && current.Size() < tailed.offset+int64(len(tailed.partial)) {
+			log.Println("Log file was truncated, reading from the beginning:", path)
+			tailed.seek(0)
+			self.track(path, tailed)
+			continue
+		}
+
+		latest, err := os.Stat(path)
+		if err == nil && os.SameFile(latest, tailed.info) {
+			continue
+		}
+		if tailed.hasNext || current.Size() > tailed.offset+int64(len(tailed.partial)) {
+			// Finish reading what was written before the rotation.
+			continue
+		}
+
+		tailed.close()
+		delete(self.files, path)
+		delete(self.offsets, path)
+
+		if err != nil {
+			continue
+		}
+		reopened, err := openTailedFile(path)
+		if err != nil {
+			log.Println("Could not reopen rotated log file:", err)
+			continue
+		}
+		self.track(path, reopened)
+	}
+}
+
+func (self *FileLogScanner) loadState() error {
+	if self.statePath == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(self.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &self.offsets)
+}
+
+// saveState writes the offsets to a temporary file and renames it over the
+// state file, so a crash never leaves a partially written state file.
+func (self *FileLogScanner) saveState() {
+	self.stateSavedAt = time.Now()
+	if self.statePath == "" {
+		return
+	}
+
+	for path, tailed := range self.files {
+		self.offsets[path] = fileOffset{Inode: inode(tailed.info), Offset: tailed.processed}
+	}
+
+	b, err := json.Marshal(self.offsets)
+	if err == nil {
+		err = writeFileAtomically(self.statePath, b)
+	}
+	if err != nil {
+		log.Println("Could not save the log file offsets:", err)
+	}
+}
+
+func writeFileAtomically(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func openTailedFile(path string) (*tailedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	head := make([]byte, tarMagicOffset+len(tarMagic))
+	n, _ := file.ReadAt(head, 0)
+
+	return &tailedFile{
+		file:    file,
+		info:    info,
+		reader:  bufio.NewReader(file),
+		archive: DetectCompression(head[:n]) != "",
+	}, nil
+}
+
+func (self *tailedFile) close() {
+	if self.logs != nil {
+		self.logs.Close()
+	}
+	self.file.Close()
+}
+
+func (self *tailedFile) seek(offset int64) {
+	self.file.Seek(offset, io.SeekStart)
+	self.reader.Reset(self.file)
+	self.offset = offset
+	self.partial = ""
+	self.next = ""
+	self.hasNext = false
+}
+
+// continued reports whether the next line, as far as it has been written, is an
+// indented continuation of the last one, like the rest of a multi-line query.
+func (self *tailedFile) continued() bool {
+	if self.archive && self.logs == nil {
+		return false
+	}
+	next, err := self.reader.Peek(1)
+	return err == nil && (next[0] == '\t' || next[0] == ' ')
+}
+
+// peekLine returns the next complete line without taking it, though the offset
+// is already past it.
+func (self *tailedFile) peekLine() (string, bool) {
+	if !self.hasNext {
+		self.next, self.hasNext = self.readLine()
+	}
+	return self.next, self.hasNext
+}
+
+// readLine returns the next complete line. A line that is still being written
+// is kept until its newline shows up.
+func (self *tailedFile) readLine() (string, bool) {
+	if self.hasNext {
+		self.hasNext = false
+		return self.next, true
+	}
+	if self.archive {
+		return self.readArchiveLine()
+	}
+
+	chunk, err := self.reader.ReadString('\n')
+	self.partial += chunk
+	if err != nil {
+		if err != io.EOF {
+			log.Println("Error reading log file:", err)
+		}
+		return "", false
+	}
+
+	line := self.partial
+	self.offset += int64(len(line))
+	self.partial = ""
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+func (self *tailedFile) readArchiveLine() (string, bool) {
+	if self.done {
+		return "", false
+	}
+
+	if self.logs == nil {
+		// Wait for whatever is compressing the file to finish writing it.
+		current, err := self.file.Stat()
+		if err != nil || current.Size() != self.info.Size() {
+			if err == nil {
+				self.info = current
+			}
+			return "", false
+		}
+
+		self.logs, err = NewLogReader(self.file)
+		if err != nil {
+			log.Println("Could not read compressed log file:", err)
+			self.finish()
+			return "", false
+		}
+		self.reader = bufio.NewReader(self.logs)
+	}
+
+	line, err := self.reader.ReadString('\n')
+	if err == nil {
+		// Finish along with the last line, so its cursor has the offset that
+		// marks the archive as read.
+		_, err = self.reader.Peek(1)
+	}
+	if err != nil {
+		if err != io.EOF {
+			log.Println("Error reading compressed log file:", err)
+		}
+		self.finish()
+		if line == "" {
+			return "", false
+		}
+	}
+	return strings.TrimRight(line, "\r\n"), true
+}
+
+// finish marks an archive as read, so its offset is saved as its size.
+func (self *tailedFile) finish() {
+	self.done = true
+	self.offset = self.info.Size()
+	if self.logs != nil {
+		self.logs.Close()
+		self.logs = nil
+	}
+}
+
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
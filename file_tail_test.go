@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendToFile(t *testing.T, path string, text string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scanLine fails the test instead of blocking forever when no line shows up.
+func scanLine(t *testing.T, scanner *FileLogScanner) string {
+	scanned := make(chan bool, 1)
+	go func() {
+		scanned <- scanner.Scan()
+	}()
+
+	select {
+	case ok := <-scanned:
+		if !ok {
+			t.Fatal("FileLogScanner.Scan stopped unexpectedly")
+		}
+		return scanner.Text()
+	case <-time.After(2 * time.Second):
+		scanner.Close()
+		t.Fatal("Timed out waiting for FileLogScanner.Scan")
+	}
+	return ""
+}
+
+// processLine scans a line and marks it as sent.
+func processLine(t *testing.T, scanner *FileLogScanner) string {
+	line := scanLine(t, scanner)
+	scanner.Processed(scanner.Record().Cursor)
+	return line
+}
+
+func newTestFileLogScanner(t *testing.T, pattern string, statePath string) *FileLogScanner {
+	scanner, err := NewFileLogScanner(pattern, statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.pollInterval = time.Millisecond * 10
+	return scanner
+}
+
+func TestFileLogScanner_FollowsFromTheEnd(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "postgresql.log")
+	appendToFile(t, path, "already logged\n")
+
+	scanner := newTestFileLogScanner(t, path, "")
+	defer scanner.Close()
+
+	appendToFile(t, path, "first\nsecond\nthird is still being wri")
+	assert.Equal(t, "first", scanLine(t, scanner))
+	assert.Equal(t, "second", scanLine(t, scanner))
+
+	appendToFile(t, path, "tten\n")
+	assert.Equal(t, "third is still being written", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_Rotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "postgresql.log")
+	appendToFile(t, path, "")
+
+	scanner := newTestFileLogScanner(t, path, "")
+	defer scanner.Close()
+
+	appendToFile(t, path, "before truncate\n")
+	assert.Equal(t, "before truncate", scanLine(t, scanner))
+
+	// copytruncate style rotation
+	os.Truncate(path, 0)
+	time.Sleep(time.Millisecond * 50)
+	appendToFile(t, path, "after\n")
+	assert.Equal(t, "after", scanLine(t, scanner))
+
+	// rename style rotation, with a line written to the old file after the rename
+	os.Rename(path, path+".1")
+	appendToFile(t, path+".1", "late line in old file\n")
+	appendToFile(t, path, "new file\n")
+	assert.Equal(t, "late line in old file", scanLine(t, scanner))
+	assert.Equal(t, "new file", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_GlobPicksUpNewFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	appendToFile(t, filepath.Join(dir, "postgresql-2021-01-11.log"), "old\n")
+
+	scanner := newTestFileLogScanner(t, filepath.Join(dir, "*.log"), "")
+	defer scanner.Close()
+
+	appendToFile(t, filepath.Join(dir, "postgresql-2021-01-12.log"), "from the start of a new file\n")
+	assert.Equal(t, "from the start of a new file", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_ResumesFromState(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "postgresql.log")
+	statePath := filepath.Join(dir, "timber.state")
+	appendToFile(t, path, "")
+
+	scanner := newTestFileLogScanner(t, path, statePath)
+	appendToFile(t, path, "one\ntwo\n")
+	assert.Equal(t, "one", processLine(t, scanner))
+	assert.Equal(t, "two", scanLine(t, scanner))
+	scanner.Close()
+	assert.False(t, scanner.Scan())
+
+	// "two" was read but never sent, and "three" was written while timber was
+	// down.
+	appendToFile(t, path, "three\n")
+
+	scanner = newTestFileLogScanner(t, path, statePath)
+	defer scanner.Close()
+	assert.Equal(t, "two", scanLine(t, scanner))
+	assert.Equal(t, "three", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_BadPattern(t *testing.T) {
+	_, err := NewFileLogScanner("[", "")
+	assert.NotNil(t, err)
+}
+
+func TestFileLogScanner_ReadsNewArchivesOnce(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	// Archives that were there before are skipped, like plain files.
+	ioutil.WriteFile(filepath.Join(dir, "postgresql-1.log.gz"), gzipBytes([]byte("old\n")), 0644)
+
+	scanner := newTestFileLogScanner(t, filepath.Join(dir, "postgresql-*"), statePath)
+	ioutil.WriteFile(filepath.Join(dir, "postgresql-2.log.gz"), gzipBytes([]byte("first\nsecond")), 0644)
+	assert.Equal(t, "first", processLine(t, scanner))
+	assert.Equal(t, "second", processLine(t, scanner))
+
+	appendToFile(t, filepath.Join(dir, "postgresql-3.log"), "third\n")
+	assert.Equal(t, "third", processLine(t, scanner))
+	scanner.Close()
+	assert.False(t, scanner.Scan())
+
+	// The archive that was read is not read again after a restart.
+	scanner = newTestFileLogScanner(t, filepath.Join(dir, "postgresql-*"), statePath)
+	defer scanner.Close()
+	appendToFile(t, filepath.Join(dir, "postgresql-3.log"), "fourth\n")
+	assert.Equal(t, "fourth", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_ReadsUnsentArchivesAgain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	scanner := newTestFileLogScanner(t, filepath.Join(dir, "postgresql-*"), statePath)
+	ioutil.WriteFile(filepath.Join(dir, "postgresql-1.log.gz"), gzipBytes([]byte("first\nsecond\n")), 0644)
+	assert.Equal(t, "first", processLine(t, scanner))
+	assert.Equal(t, "second", scanLine(t, scanner))
+	scanner.Close()
+	assert.False(t, scanner.Scan())
+
+	// The archive is only done once its last line has been sent.
+	scanner = newTestFileLogScanner(t, filepath.Join(dir, "postgresql-*"), statePath)
+	defer scanner.Close()
+	assert.Equal(t, "first", scanLine(t, scanner))
+	assert.Equal(t, "second", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_IgnoresCursorsFromBeforeTruncation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "postgresql.log")
+	statePath := filepath.Join(dir, "timber.state")
+	appendToFile(t, path, "")
+
+	scanner := newTestFileLogScanner(t, path, statePath)
+	appendToFile(t, path, "a long line from before the truncation\n")
+	scanLine(t, scanner)
+	cursor := scanner.Record().Cursor
+
+	os.Truncate(path, 0)
+	time.Sleep(time.Millisecond * 50)
+	appendToFile(t, path, "after\n")
+	assert.Equal(t, "after", scanLine(t, scanner))
+
+	scanner.Processed(cursor)
+	scanner.Close()
+	assert.False(t, scanner.Scan())
+
+	scanner = newTestFileLogScanner(t, path, statePath)
+	defer scanner.Close()
+	assert.Equal(t, "after", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_TakesTurnsBetweenFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	busy := filepath.Join(dir, "a.log")
+	quiet := filepath.Join(dir, "b.log")
+	appendToFile(t, busy, "")
+	appendToFile(t, quiet, "")
+
+	scanner := newTestFileLogScanner(t, filepath.Join(dir, "*.log"), "")
+	defer scanner.Close()
+
+	lines := ""
+	for i := 0; i < fileLinesPerTurn; i++ {
+		lines += "busy\n"
+	}
+	appendToFile(t, busy, lines+"\tthe rest of the last busy line\nbusy again\n")
+	appendToFile(t, quiet, "quiet\n")
+
+	for i := 0; i < fileLinesPerTurn; i++ {
+		assert.Equal(t, "busy", scanLine(t, scanner))
+	}
+	// The busy file is left once its turn is over, but not in the middle of
+	// a multi-line entry.
+	assert.Equal(t, "\tthe rest of the last busy line", scanLine(t, scanner))
+	assert.Equal(t, "quiet", scanLine(t, scanner))
+	assert.Equal(t, "busy again", scanLine(t, scanner))
+}
+
+func TestFileLogScanner_EndsTurnsBetweenEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "timber")
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "a.log")
+	second := filepath.Join(dir, "b.log")
+	appendToFile(t, first, "")
+	appendToFile(t, second, "")
+
+	scanner := newTestFileLogScanner(t, filepath.Join(dir, "*.log"), "")
+	scanner.startsEntry = MustLogLinePrefix(DefaultLogLinePrefix).StartsEntry
+	defer scanner.Close()
+
+	entries := func(pid int) string {
+		lines := ""
+		for i := 1; i < fileLinesPerTurn; i++ {
+			lines += fmt.Sprintf("2021-02-19 15:04:05 UTC [%d-3/9939-%d] app@ledger LOG:  statement: SELECT %d\n", pid, i, i)
+		}
+		return lines
+	}
+	appendToFile(t, first, entries(1)+
+		"2021-02-19 15:04:05 UTC [1-3/9939-1000] app@ledger ERROR:  deadlock detected\n"+
+		"2021-02-19 15:04:05 UTC [1-3/9939-1001] app@ledger DETAIL:  Process 1 waits for ShareLock on transaction 2\n"+
+		"2021-02-19 15:04:06 UTC [1-3/9939-1002] app@ledger LOG:  statement: SELECT 1002\n")
+	appendToFile(t, second, entries(2))
+
+	for i := 1; i < fileLinesPerTurn; i++ {
+		scanLine(t, scanner)
+	}
+	assert.Contains(t, scanLine(t, scanner), "ERROR:  deadlock detected")
+	// The DETAIL belongs to the ERROR, which has to be followed by it rather
+	// than by a line of the other file.
+	assert.Contains(t, scanLine(t, scanner), "DETAIL:  Process 1 waits")
+	assert.Contains(t, scanLine(t, scanner), "[2-3/9939-1]")
+	assert.Equal(t, filepath.Join(dir, "b.log"), scanner.Path())
+
+	for i := 2; i < fileLinesPerTurn; i++ {
+		scanLine(t, scanner)
+	}
+	// The line read ahead of the first file is where it picks up again.
+	assert.Contains(t, scanLine(t, scanner), "SELECT 1002")
+}
@@ -3,8 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var RegexBeginningOfJournaldLogLine = regexp.MustCompile(`^\[\d+\-\d+] `)
@@ -24,46 +31,159 @@ type JournalMessage struct {
 	Transport string `json:"_TRANSPORT"`
 	UID       string `json:"_UID"`
 	Timestamp string `json:"__REALTIME_TIMESTAMP"`
+	Cursor    string `json:"__CURSOR"`
 }
 
-func journalctl(tag string) (*bufio.Scanner, error) {
-	c := exec.Command("/bin/journalctl", "-t", tag, "-f", "-o", "json", "-n", "0")
+// How often the cursor file is written while entries are being processed.
+const journaldCursorSaveInterval = time.Second
+
+// JournaldOptions selects the journal entries timber reads.
+type JournaldOptions struct {
+	// The journalctl binary.
+	JournalctlPath string `json:"journalctl_path"`
+	// The SYSLOG_IDENTIFIER of the entries, none when empty.
+	Identifier string `json:"identifier"`
+	// The systemd units of the entries, ie: "postgresql@14-main".
+	Units []string `json:"units"`
+	// Extra "FIELD=value" matches on any journal field.
+	Matches []string `json:"matches"`
+	// Read the journal files in this directory instead of the system journal.
+	Directory string `json:"directory"`
+	// Read these exported journal files instead of the system journal. They are
+	// read from the beginning and timber stops at their end.
+	Files []string `json:"files"`
+	// Save the cursor of the last processed entry here and resume after it.
+	CursorPath string `json:"cursor_path"`
+}
+
+func DefaultJournaldOptions() JournaldOptions {
+	return JournaldOptions{
+		JournalctlPath: "/bin/journalctl",
+		Identifier:     "postgres",
+	}
+}
+
+// Validate checks the matches, journalctl only reports a bad match once it runs.
+func (self JournaldOptions) Validate() error {
+	for _, match := range self.Matches {
+		if strings.Index(match, "=") < 1 {
+			return fmt.Errorf("journald match %q is not of the form FIELD=value", match)
+		}
+	}
+	return nil
+}
+
+// journalctlArgs follows new entries, or the entries after cursor when
+// resuming. Journal files are read once from the beginning.
+func journalctlArgs(options JournaldOptions, cursor string) []string {
+	args := []string{"-o", "json"}
+	if options.Identifier != "" {
+		args = append(args, "-t", options.Identifier)
+	}
+	for _, unit := range options.Units {
+		args = append(args, "-u", unit)
+	}
+	if options.Directory != "" {
+		args = append(args, "--directory="+options.Directory)
+	}
+	for _, file := range options.Files {
+		args = append(args, "--file="+file)
+	}
+
+	switch {
+	case cursor != "":
+		args = append(args, "--after-cursor="+cursor)
+	case len(options.Files) == 0:
+		args = append(args, "-n", "0")
+	}
+	if len(options.Files) == 0 {
+		args = append(args, "-f")
+	}
+
+	return append(args, options.Matches...)
+}
+
+func journalctl(options JournaldOptions, cursor string) (*exec.Cmd, *bufio.Scanner, error) {
+	c := exec.Command(options.JournalctlPath, journalctlArgs(options, cursor)...)
 	stdout, err := c.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = c.Start()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return bufio.NewScanner(stdout), nil
+	return c, bufio.NewScanner(stdout), nil
 }
 
+// JournaldScanner reads postgres entries from journalctl. When it has a cursor
+// path it saves the cursor of the last processed entry there, and resumes after
+// it on the next start. Entries that were read but not yet processed when timber
+// stopped are read again, so delivery is at least once.
 type JournaldScanner struct {
 	scanner     *bufio.Scanner
 	nextMessage *JournalMessage
 	nextError   error
+
+	cmd             *exec.Cmd
+	cursorPath      string
+	processedCursor string
+	cursorSavedAt   time.Time
 }
 
-func NewJournaldLogScanner() (LogScanner, error) {
-	scanner, err := journalctl("postgres")
+func NewJournaldLogScanner(options JournaldOptions) (*JournaldScanner, error) {
+	err := options.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := loadJournaldCursor(options.CursorPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, scanner, err := journalctl(options, cursor)
 	if err != nil {
 		return nil, err
 	}
 	return &JournaldScanner{
-		scanner:     scanner,
-		nextMessage: new(JournalMessage),
+		scanner:         scanner,
+		nextMessage:     new(JournalMessage),
+		cmd:             cmd,
+		cursorPath:      options.CursorPath,
+		processedCursor: cursor,
 	}, nil
 }
 
+func loadJournaldCursor(cursorPath string) (string, error) {
+	if cursorPath == "" {
+		return "", nil
+	}
+
+	b, err := ioutil.ReadFile(cursorPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
 func (self *JournaldScanner) Scan() bool {
 	self.nextError = nil
 
 	if !self.scanner.Scan() {
 		self.nextError = self.scanner.Err() // ???
+		if self.cmd != nil {
+			// Reap journalctl once its output has ended.
+			self.cmd.Wait()
+		}
 		return false
 	}
 
+	// Reset the message so fields missing from this entry are not carried over.
+	*self.nextMessage = JournalMessage{}
 	bytes := []byte(self.scanner.Text())
 	err := json.Unmarshal(bytes, self.nextMessage)
 	if err != nil {
@@ -85,3 +205,67 @@ func (self *JournaldScanner) Text() string {
 func (self *JournaldScanner) Err() error {
 	return self.nextError
 }
+
+// Cursor returns the journald cursor of the last scanned entry.
+func (self *JournaldScanner) Cursor() string {
+	return self.nextMessage.Cursor
+}
+
+// Record returns the last scanned entry along with its cursor and the fields
+// journald adds about the process that logged it.
+func (self *JournaldScanner) Record() *LogRecord {
+	return &LogRecord{
+		Text:   self.nextMessage.Message,
+		Cursor: self.nextMessage.Cursor,
+		Source: self.nextMessage.SourceMetadata(),
+	}
+}
+
+func (self *JournalMessage) SourceMetadata() *SourceMetadata {
+	metadata := &SourceMetadata{
+		HostName: self.HostName,
+		Unit:     self.Unit,
+		BootID:   self.BootId,
+	}
+	metadata.PID, _ = strconv.Atoi(self.PID)
+
+	// The realtime timestamp is in microseconds since the epoch.
+	if microseconds, err := strconv.ParseInt(self.Timestamp, 10, 64); err == nil {
+		metadata.Timestamp = time.Unix(0, microseconds*int64(time.Microsecond)).UTC().String()
+	}
+	return metadata
+}
+
+// Processed records that everything up to cursor has been sent, and saves it
+// at most once every journaldCursorSaveInterval.
+func (self *JournaldScanner) Processed(cursor string) {
+	if cursor == "" {
+		return
+	}
+	self.processedCursor = cursor
+	if time.Since(self.cursorSavedAt) >= journaldCursorSaveInterval {
+		self.SaveState()
+	}
+}
+
+// SaveState writes the cursor of the last processed entry to a temporary file
+// and renames it over the cursor file.
+func (self *JournaldScanner) SaveState() {
+	self.cursorSavedAt = time.Now()
+	if self.cursorPath == "" || self.processedCursor == "" {
+		return
+	}
+
+	err := writeFileAtomically(self.cursorPath, []byte(self.processedCursor+"\n"))
+	if err != nil {
+		log.Println("Could not save the journald cursor:", err)
+	}
+}
+
+// Close stops journalctl, which makes Scan return false. It is safe to call
+// from another goroutine.
+func (self *JournaldScanner) Close() {
+	if self.cmd != nil && self.cmd.Process != nil {
+		self.cmd.Process.Kill()
+	}
+}
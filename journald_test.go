@@ -2,6 +2,10 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -31,3 +35,183 @@ func TestJournaldScanner_ScrubbingLinesWithPrefix(t *testing.T) {
 	assert.Equal(t, journaldScanner.Text(), "Brolo")
 	assert.False(t, journaldScanner.Scan())
 }
+
+func TestJournalctlArgs(t *testing.T) {
+	options := DefaultJournaldOptions()
+	assert.Equal(t, []string{"-o", "json", "-t", "postgres", "-n", "0", "-f"}, journalctlArgs(options, ""))
+	assert.Equal(t, []string{"-o", "json", "-t", "postgres", "--after-cursor=s=abc;i=2", "-f"}, journalctlArgs(options, "s=abc;i=2"))
+}
+
+func TestJournalctlArgs_Filters(t *testing.T) {
+	options := DefaultJournaldOptions()
+	options.Identifier = ""
+	options.Units = []string{"postgresql@14-main", "postgresql@14-replica"}
+	options.Matches = []string{"_HOSTNAME=db1"}
+	options.Directory = "/var/log/journal/remote"
+
+	assert.Equal(t, []string{
+		"-o", "json",
+		"-u", "postgresql@14-main",
+		"-u", "postgresql@14-replica",
+		"--directory=/var/log/journal/remote",
+		"-n", "0",
+		"-f",
+		"_HOSTNAME=db1",
+	}, journalctlArgs(options, ""))
+}
+
+func TestJournalctlArgs_Files(t *testing.T) {
+	options := DefaultJournaldOptions()
+	options.Files = []string{"/tmp/system.journal", "/tmp/system@1.journal"}
+
+	// Exported files are read from the beginning, without following them.
+	assert.Equal(t, []string{
+		"-o", "json",
+		"-t", "postgres",
+		"--file=/tmp/system.journal",
+		"--file=/tmp/system@1.journal",
+	}, journalctlArgs(options, ""))
+}
+
+func TestJournaldOptions_Validate(t *testing.T) {
+	options := DefaultJournaldOptions()
+	assert.Nil(t, options.Validate())
+
+	options.Matches = []string{"_SYSTEMD_UNIT=postgresql.service", "PRIORITY="}
+	assert.Nil(t, options.Validate())
+
+	options.Matches = []string{"postgresql.service"}
+	assert.NotNil(t, options.Validate())
+
+	options.Matches = []string{"=postgresql.service"}
+	assert.NotNil(t, options.Validate())
+}
+
+func TestJournaldScanner_Cursor(t *testing.T) {
+	log := `{"MESSAGE":"Hello","__CURSOR":"s=abc;i=1"}
+{"MESSAGE":"World"}
+`
+
+	journaldScanner := &JournaldScanner{
+		scanner:     bufio.NewScanner(strings.NewReader(log)),
+		nextMessage: new(JournalMessage),
+	}
+
+	assert.True(t, journaldScanner.Scan())
+	assert.Equal(t, "s=abc;i=1", journaldScanner.Cursor())
+	assert.True(t, journaldScanner.Scan())
+	assert.Equal(t, "", journaldScanner.Cursor())
+}
+
+func TestJournaldScanner_SavesAndLoadsCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cursorPath := filepath.Join(dir, "cursor")
+
+	cursor, err := loadJournaldCursor(cursorPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "", cursor)
+
+	journaldScanner := &JournaldScanner{cursorPath: cursorPath}
+	journaldScanner.Processed("s=abc;i=1")
+	cursor, err = loadJournaldCursor(cursorPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "s=abc;i=1", cursor)
+
+	// Later cursors wait for the save interval or an explicit save.
+	journaldScanner.Processed("s=abc;i=2")
+	journaldScanner.Processed("")
+	cursor, _ = loadJournaldCursor(cursorPath)
+	assert.Equal(t, "s=abc;i=1", cursor)
+
+	journaldScanner.SaveState()
+	cursor, _ = loadJournaldCursor(cursorPath)
+	assert.Equal(t, "s=abc;i=2", cursor)
+}
+
+func TestPostgresLogParser_JournaldCursor(t *testing.T) {
+	log := `{"MESSAGE":"[24-1] 2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 1","__CURSOR":"i=1"}
+{"MESSAGE":"[24-2] 2021-02-19 15:04:05 UTC [56193-3/9939-5707] app@ledger LOG:  duration: 2.000 ms  statement: SELECT 2","__CURSOR":"i=2"}
+{"MESSAGE":"[24-3] \tAND 1 = 1","__CURSOR":"i=3"}
+`
+
+	journaldScanner := &JournaldScanner{
+		scanner:     bufio.NewScanner(strings.NewReader(log)),
+		nextMessage: new(JournalMessage),
+	}
+	parser := NewPostgresLogParser(journaldScanner)
+
+	first, err := parser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "i=1", first.Cursor)
+
+	// The cursor of an entry is the one of its last line.
+	second, err := parser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "i=3", second.Cursor)
+}
+
+func TestNewJournaldLogScanner_JournalctlPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A stand-in for journalctl that prints one entry for each file it is given.
+	journalctlPath := filepath.Join(dir, "journalctl")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do case $arg in --file=*) echo \"{\\\"MESSAGE\\\":\\\"${arg#--file=}\\\"}\";; esac; done\n"
+	assert.Nil(t, ioutil.WriteFile(journalctlPath, []byte(script), 0755))
+
+	options := DefaultJournaldOptions()
+	options.JournalctlPath = journalctlPath
+	options.Files = []string{"a.journal", "b.journal"}
+
+	journaldScanner, err := NewJournaldLogScanner(options)
+	assert.Nil(t, err)
+	assert.True(t, journaldScanner.Scan())
+	assert.Equal(t, "a.journal", journaldScanner.Text())
+	assert.True(t, journaldScanner.Scan())
+	assert.Equal(t, "b.journal", journaldScanner.Text())
+	assert.False(t, journaldScanner.Scan())
+}
+
+func TestPostgresLogParser_JournaldMetadata(t *testing.T) {
+	log := `{"MESSAGE":"[24-1] 2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 1","_HOSTNAME":"db1","_PID":"56193","_SYSTEMD_UNIT":"postgresql@14-main.service","_BOOT_ID":"b0b0","__REALTIME_TIMESTAMP":"1613747045123456"}
+{"MESSAGE":"[25-1] 2021-02-19 15:04:06 UTC [56193-3/9939-5707] app@ledger LOG:  duration: 2.000 ms  statement: SELECT 2"}
+`
+
+	journaldScanner := &JournaldScanner{
+		scanner:     bufio.NewScanner(strings.NewReader(log)),
+		nextMessage: new(JournalMessage),
+	}
+	parser := NewPostgresLogParser(journaldScanner)
+
+	logLine, err := parser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, &SourceMetadata{
+		HostName:  "db1",
+		Unit:      "postgresql@14-main.service",
+		PID:       56193,
+		BootID:    "b0b0",
+		Timestamp: "2021-02-19 15:04:05.123456 +0000 UTC",
+	}, logLine.Source)
+	assert.Equal(t, "db1", logLine.HostName())
+
+	msg := ParseSlowQuery(logLine)
+	assert.Equal(t, "timber.postgres_slow_query", msg.Type)
+	assert.Equal(t, "SELECT 1", msg.Query)
+	assert.Equal(t, 1.0, msg.DurationInMilliseconds)
+	assert.Equal(t, "db1", msg.HostName)
+	b, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"hostname":"db1"`)
+	assert.Contains(t, string(b), `"journald_unit":"postgresql@14-main.service","journald_pid":56193,"journald_boot_id":"b0b0","journald_timestamp":"2021-02-19 15:04:05.123456 +0000 UTC"`)
+
+	// Entries without the fields fall back to the host timber runs on.
+	logLine, err = parser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, HostName(), logLine.HostName())
+	b, err = json.Marshal(ParseSlowQuery(logLine))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "journald_")
+}
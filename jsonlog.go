@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+)
+
+// JSONLogMessage is a single entry written by log_destination = jsonlog, which
+// was added in postgres 15. Keys are left out of an entry when they are empty.
+type JSONLogMessage struct {
+	Timestamp        string `json:"timestamp"`
+	User             string `json:"user"`
+	Database         string `json:"dbname"`
+	PID              int    `json:"pid"`
+	RemoteHost       string `json:"remote_host"`
+	RemotePort       int    `json:"remote_port"`
+	SessionID        string `json:"session_id"`
+	LineNumber       int    `json:"line_num"`
+	CommandTag       string `json:"ps"`
+	SessionStart     string `json:"session_start"`
+	VirtualTxID      string `json:"vxid"`
+	TxID             int64  `json:"txid"`
+	Severity         string `json:"error_severity"`
+	StateCode        string `json:"state_code"`
+	Message          string `json:"message"`
+	Detail           string `json:"detail"`
+	Hint             string `json:"hint"`
+	InternalQuery    string `json:"internal_query"`
+	InternalPosition int    `json:"internal_position"`
+	Context          string `json:"context"`
+	Statement        string `json:"statement"`
+	CursorPosition   int    `json:"cursor_position"`
+	ApplicationName  string `json:"application_name"`
+	BackendType      string `json:"backend_type"`
+	LeaderPID        int    `json:"leader_pid"`
+	QueryID          int64  `json:"query_id"`
+}
+
+// JSONLogParser reads postgres jsonlog entries, one JSON object per line.
+type JSONLogParser struct {
+	logScanner LogScanner
+}
+
+func NewJSONLogParser(logScanner LogScanner) *JSONLogParser {
+	return &JSONLogParser{
+		logScanner: logScanner,
+	}
+}
+
+func (self *JSONLogParser) Parse() (*PostgresLogLine, error) {
+	for self.logScanner.Scan() {
+		text := self.logScanner.Text()
+		if len(text) == 0 {
+			continue
+		}
+
+		msg := new(JSONLogMessage)
+		err := json.Unmarshal([]byte(text), msg)
+		if err != nil {
+			return nil, err
+		}
+
+		log := msg.PostgresLogLine()
+		if recordScanner, ok := self.logScanner.(RecordLogScanner); ok {
+			record := recordScanner.Record()
+			log.Cursor = record.Cursor
+			log.Source = record.Source
+		}
+		err = parseMessage(log)
+		if err != nil {
+			return nil, err
+		}
+		return log, nil
+	}
+
+	// The scanner stops for good on an error, like a line that is too long.
+	if err := self.logScanner.Err(); err != nil {
+		log.Println("Could not read the jsonlog:", err)
+	}
+	return nil, ErrLogEOF
+}
+
+func (self *JSONLogMessage) PostgresLogLine() *PostgresLogLine {
+	log := &PostgresLogLine{
+		Timestamp:            parsePrefixTime(self.Timestamp),
+		Username:             self.User,
+		Database:             self.Database,
+		Severity:             self.Severity,
+		PID:                  self.PID,
+		LineNumber:           self.LineNumber,
+		SessionID:            self.SessionID,
+		ApplicationName:      self.ApplicationName,
+		RemoteHost:           self.RemoteHost,
+		BackendType:          self.BackendType,
+		CommandTag:           self.CommandTag,
+		SQLState:             self.StateCode,
+		VirtualTransactionID: self.VirtualTxID,
+		TransactionID:        strconv.FormatInt(self.TxID, 10),
+		Message:              self.Message,
+		Detail:               self.Detail,
+		Hint:                 self.Hint,
+		Context:              self.Context,
+		Statement:            self.Statement,
+		QueryPosition:        self.CursorPosition,
+	}
+	if self.RemotePort != 0 {
+		log.RemotePort = strconv.Itoa(self.RemotePort)
+	}
+	if self.QueryID != 0 {
+		log.QueryID = strconv.FormatInt(self.QueryID, 10)
+	}
+	return log
+}
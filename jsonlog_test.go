@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLogParser_DurationEntries(t *testing.T) {
+	log := `{"timestamp":"2022-10-12 14:01:02.345 UTC","user":"app","dbname":"ledger","pid":4242,"remote_host":"10.1.2.3","remote_port":51234,"session_id":"6346c8a2.1092","line_num":7,"ps":"SELECT","session_start":"2022-10-12 14:00:00 UTC","vxid":"3/17","txid":0,"error_severity":"LOG","message":"duration: 12.500 ms  execute <unnamed>: SELECT * FROM abacus3_qa.transactions WHERE guid = $1","detail":"parameters: $1 = 'TRN-123'","application_name":"rails","backend_type":"client backend","query_id":-4411283745215862466}
+
+{"timestamp":"2022-10-12 14:01:03.000 UTC","pid":4240,"error_severity":"LOG","message":"checkpoint starting: time","backend_type":"checkpointer","query_id":0}
+{"timestamp":"2022-10-12 14:01:04.000 UTC","user":"app","dbname":"ledger","pid":4242,"error_severity":"LOG","message":"duration: 1.000 ms  statement: SELECT 1\nFROM dual","query_id":0}
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewJSONLogParser(scanner)
+
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "execute", pgLog.LogType)
+	assert.Equal(t, "<unnamed>", pgLog.StatementName)
+	assert.Equal(t, `SELECT * FROM abacus3_qa.transactions WHERE guid = $1`, pgLog.Value)
+	assert.Equal(t, time.Duration(12500000), pgLog.Duration)
+	assert.Equal(t, "app", pgLog.Username)
+	assert.Equal(t, "ledger", pgLog.Database)
+	assert.Equal(t, 4242, pgLog.PID)
+	assert.Equal(t, 7, pgLog.LineNumber)
+	assert.Equal(t, "51234", pgLog.RemotePort)
+	assert.Equal(t, "rails", pgLog.ApplicationName)
+	assert.Equal(t, "parameters: $1 = 'TRN-123'", pgLog.Detail)
+	assert.Equal(t, "-4411283745215862466", pgLog.QueryID)
+	assert.Equal(t, 345*time.Millisecond, time.Duration(pgLog.Timestamp.Nanosecond()))
+
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrInvalidLogLine, err)
+
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "statement", pgLog.LogType)
+	assert.Equal(t, "SELECT 1\nFROM dual", pgLog.Value)
+	assert.Equal(t, "", pgLog.QueryID)
+
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
+
+func TestJSONLogParser_InvalidJSON(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("not json\n"))
+	logParser := NewJSONLogParser(scanner)
+
+	_, err := logParser.Parse()
+	assert.NotNil(t, err)
+	assert.NotEqual(t, ErrLogEOF, err)
+
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
+
+func TestJSONLogParser_LineTooLong(t *testing.T) {
+	line := `{"error_severity":"LOG","message":"` + strings.Repeat("x", 70*1024) + `"}`
+	scanner := bufio.NewScanner(strings.NewReader(line + "\n"))
+	logParser := NewJSONLogParser(scanner)
+
+	// The scanner gives up on the line, and so does the parser rather than
+	// failing forever.
+	_, err := logParser.Parse()
+	assert.Equal(t, ErrLogEOF, err)
+}
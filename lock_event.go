@@ -0,0 +1,221 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ie: "process 12345 still waiting for ShareLock on transaction 789 after 1000.123 ms"
+	RegexLockWait = regexp.MustCompile(`^process (\d+) (still waiting for|acquired|detected deadlock while waiting for|avoided deadlock for) (\S+) on (.+?) after ([\d.]+) ms`)
+	// ie: "Processes holding the lock: 12346, 12347. Wait queue: 12345."
+	RegexLockHolders   = regexp.MustCompile(`Process(?:es)? holding the lock: ([\d, ]+)\.`)
+	RegexLockWaitQueue = regexp.MustCompile(`Wait queue: ([\d, ]+)\.`)
+	// ie: "Process 12345 waits for ShareLock on transaction 790; blocked by process 12346."
+	RegexDeadlockWait = regexp.MustCompile(`^Process (\d+) waits for (\S+) on (.+?); blocked by process (\d+)\.$`)
+	// ie: "Process 12345: UPDATE accounts SET balance = 1 WHERE id = 1"
+	RegexDeadlockQuery  = regexp.MustCompile(`^Process (\d+): (.*)$`)
+	RegexLockObjectType = regexp.MustCompile(`^(virtual transaction|advisory lock|extension of relation|speculative token|\w+)`)
+)
+
+const (
+	deadlockSQLState     = "40P01"
+	deadlockErrorMessage = "deadlock detected"
+)
+
+// The event recorded for each phrasing of a log_lock_waits message.
+var lockWaitEvents = map[string]string{
+	"still waiting for":                   "waiting",
+	"acquired":                            "acquired",
+	"detected deadlock while waiting for": "deadlock_detected",
+	"avoided deadlock for":                "deadlock_avoided",
+}
+
+// lockEventLogType returns "lock_wait" for log_lock_waits entries, "deadlock"
+// for deadlock errors, or an empty string for anything else.
+func lockEventLogType(logLine *PostgresLogLine) string {
+	if RegexLockWait.MatchString(logLine.Message) {
+		return "lock_wait"
+	}
+	if logLine.SQLState == deadlockSQLState || (IsErrorSeverity(logLine.Severity) && logLine.Message == deadlockErrorMessage) {
+		return "deadlock"
+	}
+	return ""
+}
+
+type LockParticipant struct {
+	PID            int    `json:"pid"`
+	LockMode       string `json:"lock_mode,omitempty"`
+	LockedObject   string `json:"locked_object,omitempty"`
+	BlockedByPID   int    `json:"blocked_by_pid,omitempty"`
+	Query          string `json:"query,omitempty"`
+	ShardName      string `json:"shard_name,omitempty"`
+	ShardlessQuery string `json:"shardless_query,omitempty"`
+}
+
+type LockEventMessage struct {
+	Event                      string             `json:"event"`
+	WaitingPID                 int                `json:"waiting_pid"`
+	BlockingPIDs               []int              `json:"blocking_pids"`
+	WaitQueue                  []int              `json:"wait_queue,omitempty"`
+	LockMode                   string             `json:"lock_mode"`
+	LockedObject               string             `json:"locked_object"`
+	LockedObjectType           string             `json:"locked_object_type"`
+	WaitDurationInMilliseconds float64            `json:"wait_duration_in_milliseconds"`
+	Participants               []*LockParticipant `json:"participants"`
+	Database                   string             `json:"database"`
+	Username                   string             `json:"username"`
+	CreatedAt                  string             `json:"created_at"`
+	Type                       string             `json:"type"`
+	HostName                   string             `json:"hostname"`
+	TimberVersion              string             `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// ParseLockEvent builds a lock event out of a log_lock_waits entry or a deadlock
+// error, along with their DETAIL and STATEMENT lines.
+func ParseLockEvent(logLine *PostgresLogLine) *LockEventMessage {
+	msg := &LockEventMessage{
+		BlockingPIDs:   []int{},
+		Database:       logLine.Database,
+		Username:       logLine.Username,
+		CreatedAt:      logLine.CreatedAt(),
+		Type:           "timber.postgres_lock_event",
+		HostName:       logLine.HostName(),
+		TimberVersion:  TimberVersion(),
+		SourceMetadata: logLine.Source,
+	}
+
+	switch logLine.LogType {
+	case "lock_wait":
+		parseLockWait(logLine, msg)
+	case "deadlock":
+		parseDeadlock(logLine, msg)
+	}
+	msg.LockedObjectType = RegexLockObjectType.FindString(msg.LockedObject)
+
+	return msg
+}
+
+func parseLockWait(logLine *PostgresLogLine, msg *LockEventMessage) {
+	match := RegexLockWait.FindStringSubmatch(logLine.Message)
+	if match == nil {
+		return
+	}
+
+	msg.Event = lockWaitEvents[match[2]]
+	msg.WaitingPID, _ = strconv.Atoi(match[1])
+	msg.LockMode = match[3]
+	msg.LockedObject = match[4]
+	msg.WaitDurationInMilliseconds, _ = strconv.ParseFloat(match[5], 64)
+
+	if holders := RegexLockHolders.FindStringSubmatch(logLine.Detail); holders != nil {
+		msg.BlockingPIDs = parsePIDList(holders[1])
+	}
+	if queue := RegexLockWaitQueue.FindStringSubmatch(logLine.Detail); queue != nil {
+		msg.WaitQueue = parsePIDList(queue[1])
+	}
+
+	participant := &LockParticipant{
+		PID:          msg.WaitingPID,
+		LockMode:     msg.LockMode,
+		LockedObject: msg.LockedObject,
+	}
+	if len(msg.BlockingPIDs) > 0 {
+		participant.BlockedByPID = msg.BlockingPIDs[0]
+	}
+	participant.setQuery(logLine.Statement)
+	msg.Participants = []*LockParticipant{participant}
+}
+
+func parseDeadlock(logLine *PostgresLogLine, msg *LockEventMessage) {
+	msg.Event = "deadlock"
+
+	participants := make(map[int]*LockParticipant)
+	order := []int{}
+	participant := func(pid int) *LockParticipant {
+		if _, ok := participants[pid]; !ok {
+			participants[pid] = &LockParticipant{PID: pid}
+			order = append(order, pid)
+		}
+		return participants[pid]
+	}
+
+	// The queries of each process can span several lines.
+	queries := make(map[int][]string)
+	var lastQueryPID int
+
+	for _, line := range strings.Split(strings.Replace(logLine.Detail, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if match := RegexDeadlockWait.FindStringSubmatch(trimmed); match != nil {
+			pid, _ := strconv.Atoi(match[1])
+			p := participant(pid)
+			p.LockMode = match[2]
+			p.LockedObject = match[3]
+			p.BlockedByPID, _ = strconv.Atoi(match[4])
+			lastQueryPID = 0
+			continue
+		}
+
+		if match := RegexDeadlockQuery.FindStringSubmatch(trimmed); match != nil {
+			lastQueryPID, _ = strconv.Atoi(match[1])
+			participant(lastQueryPID)
+			queries[lastQueryPID] = append(queries[lastQueryPID], match[2])
+			continue
+		}
+
+		if lastQueryPID != 0 {
+			queries[lastQueryPID] = append(queries[lastQueryPID], line)
+		}
+	}
+
+	for _, pid := range order {
+		p := participants[pid]
+		p.setQuery(strings.Join(queries[pid], "\n"))
+		msg.Participants = append(msg.Participants, p)
+	}
+
+	// The process that logged the error is the one whose transaction was aborted.
+	msg.WaitingPID = logLine.PID
+	if _, ok := participants[msg.WaitingPID]; !ok && len(order) > 0 {
+		msg.WaitingPID = order[0]
+	}
+	if waiting, ok := participants[msg.WaitingPID]; ok {
+		msg.LockMode = waiting.LockMode
+		msg.LockedObject = waiting.LockedObject
+		if waiting.BlockedByPID != 0 {
+			msg.BlockingPIDs = []int{waiting.BlockedByPID}
+		}
+		if waiting.Query == "" {
+			waiting.setQuery(logLine.Statement)
+		}
+	}
+}
+
+func (self *LockParticipant) setQuery(query string) {
+	if query == "" {
+		return
+	}
+	shardName, shardlessQuery := DerivedValues(query)
+	self.Query = ScrubQuery(query)
+	self.ShardName = shardName
+	self.ShardlessQuery = ScrubQuery(shardlessQuery)
+}
+
+func parsePIDList(list string) []int {
+	pids := []int{}
+	for _, field := range strings.Split(list, ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+func LogLockEvent(logLine *PostgresLogLine, sink Sink) {
+	SendMessage(ParseLockEvent(logLine), sink)
+}
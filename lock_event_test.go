@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingLockWait(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [12345-3/9939-20] app@ledger LOG:  process 12345 still waiting for ShareLock on transaction 789 after 1000.123 ms
+2021-01-11 15:25:36 EST [12345-3/9939-21] app@ledger DETAIL:  Processes holding the lock: 12346, 12347. Wait queue: 12345, 12348.
+2021-01-11 15:25:36 EST [12345-3/9939-22] app@ledger CONTEXT:  while updating tuple (0,1) in relation "accounts"
+2021-01-11 15:25:36 EST [12345-3/9939-23] app@ledger STATEMENT:  UPDATE accounts SET balance = '13.37' FROM abacus3_qa.users WHERE id = 1
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "lock_wait", pgLog.LogType)
+
+	msg := ParseLockEvent(pgLog)
+	assert.Equal(t, "timber.postgres_lock_event", msg.Type)
+	assert.Equal(t, "waiting", msg.Event)
+	assert.Equal(t, 12345, msg.WaitingPID)
+	assert.Equal(t, []int{12346, 12347}, msg.BlockingPIDs)
+	assert.Equal(t, []int{12345, 12348}, msg.WaitQueue)
+	assert.Equal(t, "ShareLock", msg.LockMode)
+	assert.Equal(t, "transaction 789", msg.LockedObject)
+	assert.Equal(t, "transaction", msg.LockedObjectType)
+	assert.Equal(t, 1000.123, msg.WaitDurationInMilliseconds)
+	assert.Len(t, msg.Participants, 1)
+	assert.Equal(t, 12346, msg.Participants[0].BlockedByPID)
+	assert.Equal(t, "UPDATE accounts SET balance = 'xxx' FROM abacus3_qa.users WHERE id = 1", msg.Participants[0].Query)
+	assert.Equal(t, "UPDATE accounts SET balance = 'xxx' FROM users WHERE id = 1", msg.Participants[0].ShardlessQuery)
+	assert.Equal(t, "abacus3_qa", msg.Participants[0].ShardName)
+}
+
+func TestParsingDeadlock(t *testing.T) {
+	log := `2021-01-11 15:25:37 EST [12345-3/9939-24] app@ledger ERROR:  deadlock detected
+2021-01-11 15:25:37 EST [12345-3/9939-25] app@ledger DETAIL:  Process 12345 waits for ShareLock on transaction 790; blocked by process 12346.
+	Process 12346 waits for ShareLock on transaction 789; blocked by process 12345.
+	Process 12345: UPDATE accounts SET balance = '1' WHERE id = 1
+	Process 12346: UPDATE accounts
+	  SET balance = '2' WHERE id = 2
+2021-01-11 15:25:37 EST [12345-3/9939-26] app@ledger HINT:  See server log for query details.
+2021-01-11 15:25:37 EST [12345-3/9939-27] app@ledger STATEMENT:  UPDATE accounts SET balance = '1' WHERE id = 1
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "deadlock", pgLog.LogType)
+
+	buffer := new(bytes.Buffer)
+	HandlePostgresLogLine(pgLog, NewWriterSink(buffer))
+
+	decoder := json.NewDecoder(buffer)
+	msg := new(LockEventMessage)
+	err = decoder.Decode(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "deadlock", msg.Event)
+	assert.Equal(t, 12345, msg.WaitingPID)
+	assert.Equal(t, []int{12346}, msg.BlockingPIDs)
+	assert.Equal(t, "ShareLock", msg.LockMode)
+	assert.Equal(t, "transaction 790", msg.LockedObject)
+	assert.Len(t, msg.Participants, 2)
+	assert.Equal(t, 12345, msg.Participants[0].PID)
+	assert.Equal(t, "UPDATE accounts SET balance = 'xxx' WHERE id = 1", msg.Participants[0].Query)
+	assert.Equal(t, 12346, msg.Participants[1].PID)
+	assert.Equal(t, 12345, msg.Participants[1].BlockedByPID)
+	assert.Equal(t, "UPDATE accounts\n\t  SET balance = 'xxx' WHERE id = 2", msg.Participants[1].Query)
+
+	// The deadlock is still counted with the other errors.
+	errorMsg := new(PostgresErrorMessage)
+	err = decoder.Decode(errorMsg)
+	assert.Nil(t, err)
+	assert.Equal(t, "timber.postgres_error", errorMsg.Type)
+	assert.Equal(t, "ERROR", errorMsg.Severity)
+	assert.Equal(t, "deadlock detected", errorMsg.Message)
+	assert.Equal(t, "UPDATE accounts SET balance = 'xxx' WHERE id = 1", errorMsg.Statement)
+	assert.False(t, decoder.More())
+}
+
+func TestLockWaitIsNotAnError(t *testing.T) {
+	logLine := &PostgresLogLine{
+		LogType:  "lock_wait",
+		Severity: "LOG",
+		Message:  "process 12345 acquired ShareLock on transaction 789 after 1000.123 ms",
+	}
+
+	buffer := new(bytes.Buffer)
+	HandlePostgresLogLine(logLine, NewWriterSink(buffer))
+
+	decoder := json.NewDecoder(buffer)
+	msg := new(LockEventMessage)
+	assert.Nil(t, decoder.Decode(msg))
+	assert.Equal(t, "acquired", msg.Event)
+	assert.False(t, decoder.More())
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLogLinePrefix is the log_line_prefix our original cluster was configured
+// with. Lines written by background processes stop at the %q.
+const DefaultLogLinePrefix = "%t [%p-%v-%l] %q%u@%d "
+
+// Every postgres log entry continues after the prefix with "SEVERITY:  ".
+const logSeverityPattern = `(?P<severity>DEBUG[1-5]|INFO|NOTICE|WARNING|ERROR|LOG|FATAL|PANIC|DETAIL|HINT|QUERY|CONTEXT|LOCATION|STATEMENT):\s+`
+
+const prefixTimestampPattern = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d{3})? \S+`
+
+type logLinePrefixEscape struct {
+	name    string
+	pattern string
+}
+
+// These are the escapes documented for log_line_prefix in postgresql.conf.
+// %r is handled separately because it contains both the host and the port.
+var logLinePrefixEscapes = map[byte]logLinePrefixEscape{
+	'a': {"application_name", `.*?`},
+	'u': {"user", `.*?`},
+	'd': {"database", `.*?`},
+	'h': {"remote_host", `\S*?`},
+	'b': {"backend_type", `.*?`},
+	'p': {"pid", `\d+`},
+	'P': {"leader_pid", `\d*`},
+	't': {"timestamp", prefixTimestampPattern},
+	'm': {"timestamp_ms", prefixTimestampPattern},
+	'n': {"timestamp_epoch", `\d+(?:\.\d+)?`},
+	'i': {"command_tag", `.*?`},
+	'e': {"sql_state", `[0-9A-Z]{5}`},
+	'c': {"session_id", `[0-9a-f]+\.[0-9a-f]+`},
+	'l': {"line_number", `\d+`},
+	's': {"session_start", prefixTimestampPattern},
+	'v': {"virtual_transaction_id", `(?:\d+/\d+)?`},
+	'x': {"transaction_id", `\d*`},
+	'Q': {"query_id", `-?\d*`},
+}
+
+// LogLinePrefix is a compiled postgresql.conf log_line_prefix. It detects the
+// beginning of a new log entry and extracts the fields the prefix contains.
+type LogLinePrefix struct {
+	format string
+	regex  *regexp.Regexp
+}
+
+// NewLogLinePrefix compiles the escape string used by log_line_prefix in
+// postgresql.conf (ie: "%m [%p] %q%u@%d ") into a matcher.
+func NewLogLinePrefix(format string) (*LogLinePrefix, error) {
+	var pattern strings.Builder
+	var literal strings.Builder
+	used := make(map[string]bool)
+	optionalGroups := 0
+
+	flushLiteral := func() {
+		pattern.WriteString(regexp.QuoteMeta(literal.String()))
+		literal.Reset()
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+
+		// Padding such as %-10u or %10u pads the value with spaces.
+		j := i + 1
+		for j < len(format) && (format[j] == '-' || (format[j] >= '0' && format[j] <= '9')) {
+			j++
+		}
+		padded := j > i+1
+		if j >= len(format) {
+			return nil, fmt.Errorf("log_line_prefix %q ends with an incomplete escape", format)
+		}
+		escape := format[j]
+		i = j
+
+		switch escape {
+		case '%':
+			literal.WriteByte('%')
+			continue
+		case 'q':
+			// Non-session processes stop writing the prefix at %q.
+			flushLiteral()
+			pattern.WriteString(`(?:`)
+			optionalGroups++
+			continue
+		}
+
+		flushLiteral()
+		if padded {
+			pattern.WriteString(` *`)
+		}
+
+		if escape == 'r' {
+			if used["remote_host"] {
+				pattern.WriteString(`\S*?(?:\(\d+\))?`)
+			} else {
+				pattern.WriteString(`(?P<remote_host>[^\s(]*?)(?:\((?P<remote_port>\d+)\))?`)
+				used["remote_host"] = true
+			}
+		} else {
+			field, ok := logLinePrefixEscapes[escape]
+			if !ok {
+				return nil, fmt.Errorf("log_line_prefix %q has an unsupported escape %%%c", format, escape)
+			}
+			if used[field.name] {
+				pattern.WriteString(`(?:` + field.pattern + `)`)
+			} else {
+				pattern.WriteString(`(?P<` + field.name + `>` + field.pattern + `)`)
+				used[field.name] = true
+			}
+		}
+
+		if padded {
+			pattern.WriteString(` *`)
+		}
+	}
+	flushLiteral()
+
+	for ; optionalGroups > 0; optionalGroups-- {
+		pattern.WriteString(`)?`)
+	}
+
+	regex, err := regexp.Compile(`^` + pattern.String() + logSeverityPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogLinePrefix{
+		format: format,
+		regex:  regex,
+	}, nil
+}
+
+// MustLogLinePrefix is like NewLogLinePrefix but panics if the format is invalid.
+func MustLogLinePrefix(format string) *LogLinePrefix {
+	prefix, err := NewLogLinePrefix(format)
+	if err != nil {
+		panic(err)
+	}
+	return prefix
+}
+
+func (self *LogLinePrefix) String() string {
+	return self.format
+}
+
+// IsNewLogLine reports whether the line starts a new postgres log entry.
+func (self *LogLinePrefix) IsNewLogLine(line string) bool {
+	return self.regex.MatchString(line)
+}
+
+// StartsEntry reports whether line is the first line of an entry, rather than
+// a line that continues the one before it, like a DETAIL or the rest of a query.
+func (self *LogLinePrefix) StartsEntry(line string) bool {
+	logLine := new(PostgresLogLine)
+	if _, ok := self.ParseInto(line, logLine); !ok {
+		return false
+	}
+	return !continuationSeverities[logLine.Severity]
+}
+
+// ParseInto fills logLine with the fields found in the prefix of buffer and
+// returns the message that follows the severity. If the buffer does not begin
+// with the prefix, ok is false and logLine is left untouched.
+func (self *LogLinePrefix) ParseInto(buffer string, logLine *PostgresLogLine) (message string, ok bool) {
+	match := self.regex.FindStringSubmatchIndex(buffer)
+	if match == nil {
+		return "", false
+	}
+
+	fields := make(map[string]string)
+	for i, name := range self.regex.SubexpNames() {
+		if name == "" || match[2*i] < 0 {
+			continue
+		}
+		fields[name] = buffer[match[2*i]:match[2*i+1]]
+	}
+
+	logLine.Username = fields["user"]
+	logLine.Database = fields["database"]
+	logLine.ApplicationName = fields["application_name"]
+	logLine.RemoteHost = fields["remote_host"]
+	logLine.RemotePort = fields["remote_port"]
+	logLine.BackendType = fields["backend_type"]
+	logLine.CommandTag = fields["command_tag"]
+	logLine.SQLState = fields["sql_state"]
+	logLine.SessionID = fields["session_id"]
+	logLine.VirtualTransactionID = fields["virtual_transaction_id"]
+	logLine.TransactionID = fields["transaction_id"]
+	logLine.QueryID = fields["query_id"]
+	logLine.Severity = fields["severity"]
+	logLine.PID, _ = strconv.Atoi(fields["pid"])
+	logLine.LineNumber, _ = strconv.Atoi(fields["line_number"])
+
+	switch {
+	case fields["timestamp_ms"] != "":
+		logLine.Timestamp = parsePrefixTime(fields["timestamp_ms"])
+	case fields["timestamp"] != "":
+		logLine.Timestamp = parsePrefixTime(fields["timestamp"])
+	case fields["timestamp_epoch"] != "":
+		seconds, _ := strconv.ParseFloat(fields["timestamp_epoch"], 64)
+		logLine.Timestamp = time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+	}
+
+	return buffer[match[1]:], true
+}
+
+// Postgres writes %t and %m with a zone abbreviation (ie: "EST", "UTC") unless
+// the zone has none, in which case it writes a numeric offset (ie: "+03").
+var prefixTimeLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05.000 MST",
+	"2006-01-02 15:04:05 -07",
+	"2006-01-02 15:04:05.000 -07",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05.000 -07:00",
+}
+
+// logTimezone resolves the zone abbreviations of log timestamps, and is set to
+// the log_timezone from postgresql.conf by -log-timezone. Go only knows the
+// abbreviations of the location it parses in, and takes any other one as UTC.
+var (
+	logTimezone              = time.Local
+	unknownAbbreviationsOnce sync.Once
+)
+
+func parsePrefixTime(value string) time.Time {
+	for _, layout := range prefixTimeLayouts {
+		timestamp, err := time.ParseInLocation(layout, value, logTimezone)
+		if err == nil {
+			zone, _ := timestamp.Zone()
+			if strings.HasSuffix(layout, "MST") && timestamp.Location() != logTimezone && zone != "UTC" && zone != "GMT" {
+				unknownAbbreviationsOnce.Do(func() {
+					log.Printf("Reading %s timestamps as UTC, pass the log_timezone from postgresql.conf with -log-timezone\n", zone)
+				})
+			}
+			return timestamp
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLinePrefix_DefaultPrefix(t *testing.T) {
+	prefix := MustLogLinePrefix(DefaultLogLinePrefix)
+
+	logLine := new(PostgresLogLine)
+	message, ok := prefix.ParseInto(`2021-01-11 15:25:36 EST [56193-3/9939-5706] postgres@walle_test LOG:  duration: 0.139 ms  bind <unnamed>: SELECT 1`, logLine)
+	assert.True(t, ok)
+	assert.Equal(t, "duration: 0.139 ms  bind <unnamed>: SELECT 1", message)
+	assert.Equal(t, "postgres", logLine.Username)
+	assert.Equal(t, "walle_test", logLine.Database)
+	assert.Equal(t, 56193, logLine.PID)
+	assert.Equal(t, 5706, logLine.LineNumber)
+	assert.Equal(t, "3/9939", logLine.VirtualTransactionID)
+	assert.Equal(t, "LOG", logLine.Severity)
+	assert.Equal(t, "2021-01-11 15:25:36", logLine.Timestamp.Format("2006-01-02 15:04:05"))
+}
+
+func TestLogLinePrefix_NonSessionProcess(t *testing.T) {
+	prefix := MustLogLinePrefix(DefaultLogLinePrefix)
+
+	logLine := new(PostgresLogLine)
+	message, ok := prefix.ParseInto(`2021-01-06 18:10:48 EST [835970--6] LOG:  database system is ready to accept connections`, logLine)
+	assert.True(t, ok)
+	assert.Equal(t, "database system is ready to accept connections", message)
+	assert.Equal(t, "", logLine.Username)
+	assert.Equal(t, "", logLine.Database)
+	assert.Equal(t, 835970, logLine.PID)
+	assert.Equal(t, 6, logLine.LineNumber)
+}
+
+func TestLogLinePrefix_CustomPrefix(t *testing.T) {
+	prefix, err := NewLogLinePrefix("%m [%p] %q%a %r %c %x %e user=%u,db=%d ")
+	assert.Nil(t, err)
+
+	logLine := new(PostgresLogLine)
+	message, ok := prefix.ParseInto(`2021-03-13 11:45:00.123 UTC [4242] PostgreSQL JDBC Driver 10.0.0.5(51234) 604d8a2c.1092 0 23505 user=app,db=ledger ERROR:  duplicate key value violates unique constraint "users_pkey"`, logLine)
+	assert.True(t, ok)
+	assert.Equal(t, `duplicate key value violates unique constraint "users_pkey"`, message)
+	assert.Equal(t, "PostgreSQL JDBC Driver", logLine.ApplicationName)
+	assert.Equal(t, "10.0.0.5", logLine.RemoteHost)
+	assert.Equal(t, "51234", logLine.RemotePort)
+	assert.Equal(t, "604d8a2c.1092", logLine.SessionID)
+	assert.Equal(t, "0", logLine.TransactionID)
+	assert.Equal(t, "23505", logLine.SQLState)
+	assert.Equal(t, "app", logLine.Username)
+	assert.Equal(t, "ledger", logLine.Database)
+	assert.Equal(t, "ERROR", logLine.Severity)
+	assert.Equal(t, 123*time.Millisecond, time.Duration(logLine.Timestamp.Nanosecond()))
+}
+
+func TestLogLinePrefix_EpochAndPadding(t *testing.T) {
+	prefix, err := NewLogLinePrefix("%n %-8u%%%d: ")
+	assert.Nil(t, err)
+
+	logLine := new(PostgresLogLine)
+	_, ok := prefix.ParseInto(`1615635900.500 bob     %ledger: LOG:  statement: SELECT 1`, logLine)
+	assert.True(t, ok)
+	assert.Equal(t, "bob", logLine.Username)
+	assert.Equal(t, "ledger", logLine.Database)
+	assert.Equal(t, int64(1615635900), logLine.Timestamp.Unix())
+}
+
+func TestLogLinePrefix_NotANewLine(t *testing.T) {
+	prefix := MustLogLinePrefix(DefaultLogLinePrefix)
+
+	assert.False(t, prefix.IsNewLogLine(`         FROM pg_attribute`))
+	assert.False(t, prefix.IsNewLogLine(`2021-01-11 15:25:36 EST some text`))
+	assert.True(t, prefix.IsNewLogLine(`2021-01-11 15:25:36 EST [56193-3/9939-5707] postgres@walle_test DETAIL:  parameters: $1 = '1'`))
+}
+
+func TestLogLinePrefix_UnsupportedEscape(t *testing.T) {
+	_, err := NewLogLinePrefix("%t %z ")
+	assert.NotNil(t, err)
+
+	_, err = NewLogLinePrefix("%t %")
+	assert.NotNil(t, err)
+}
+
+func TestParsingWithCustomPrefix(t *testing.T) {
+	log := `2021-03-13 11:45:00.123 UTC [4242] app@ledger LOG:  duration: 12.500 ms  statement: SELECT * FROM transactions
+2021-03-13 11:45:01.000 UTC [4243] LOG:  duration: 1.000 ms  statement: SELECT 1
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParserWithPrefix(scanner, MustLogLinePrefix("%m [%p] %q%u@%d "))
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "app", pgLog.Username)
+	assert.Equal(t, "ledger", pgLog.Database)
+	assert.Equal(t, 4242, pgLog.PID)
+	assert.Equal(t, "statement", pgLog.LogType)
+	assert.Equal(t, "SELECT * FROM transactions", pgLog.Value)
+	assert.Equal(t, time.Duration(12500000), pgLog.Duration)
+
+	// A line without an "@" no longer panics, it just has no user or database.
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "", pgLog.Username)
+	assert.Equal(t, "SELECT 1", pgLog.Value)
+}
@@ -1,28 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"log/syslog"
 )
 
-var (
-	KibanaLogger io.Writer
-)
-
-func init() {
-	var err error
-	KibanaLogger, err = syslog.New(syslog.LOG_LOCAL1|syslog.LOG_INFO, "timber")
+// SendMessage encodes msg as json and writes it to sink.
+func SendMessage(msg interface{}, sink Sink) {
+	event, err := NewEvent(msg)
 	if err != nil {
-		panic(err)
+		fmt.Println("Could not encode the message as json:", err)
+		return
 	}
-}
 
-func SendToKibana(b []byte) {
-	buffer := bytes.NewBuffer(b)
-	_, err := io.Copy(KibanaLogger, buffer)
+	err = sink.Write(context.Background(), event)
 	if err != nil {
-		fmt.Println("Failed to write message to kibana:", err)
+		fmt.Println("Failed to send message:", err)
 	}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type LokiOptions struct {
+	// The url of Loki, ie: "http://loki:3100".
+	URL string
+	// Basic auth, ie: for Grafana Cloud, and the tenant of a multi-tenant Loki.
+	Username string
+	Password string
+	TenantID string
+	// A batch is pushed once it has this many messages, or once the flush
+	// interval has passed.
+	BatchSize     int
+	FlushInterval time.Duration
+	// How many times a push that failed is tried again, waiting RetryBackoff
+	// longer each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func DefaultLokiOptions() LokiOptions {
+	return LokiOptions{
+		BatchSize:     500,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    3,
+		RetryBackoff:  time.Second,
+	}
+}
+
+// Set by flags for every loki sink.
+var lokiOptions = DefaultLokiOptions()
+
+func init() {
+	RegisterSink("loki", func(target string) (Sink, error) {
+		options := lokiOptions
+		options.URL = target
+		return NewLokiSink(options)
+	})
+}
+
+// The fields of a message that become the labels of its stream. Everything
+// else, like the query, stays in the log line so streams stay few.
+var lokiLabelFields = []string{"database", "shard_name", "type"}
+
+// lokiEntry is a message waiting to be pushed.
+type lokiEntry struct {
+	labels    map[string]string
+	timestamp time.Time
+	line      string
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPush struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+// LokiSink pushes messages to Grafana Loki, in streams labeled by job, database,
+// shard name and type.
+type LokiSink struct {
+	*batcher
+	options LokiOptions
+	client  *http.Client
+}
+
+func NewLokiSink(options LokiOptions) (*LokiSink, error) {
+	if options.URL == "" {
+		return nil, errors.New("the loki sink needs a url, ie: loki:http://loki:3100")
+	}
+
+	defaults := DefaultLokiOptions()
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaults.FlushInterval
+	}
+	options.URL = strings.TrimSuffix(options.URL, "/")
+	if !strings.HasSuffix(options.URL, "/loki/api/v1/push") {
+		options.URL += "/loki/api/v1/push"
+	}
+
+	sink := &LokiSink{
+		options: options,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	sink.batcher = newBatcher("loki", batcherOptions{
+		BatchSize:     options.BatchSize,
+		FlushInterval: options.FlushInterval,
+		MaxRetries:    options.MaxRetries,
+		RetryBackoff:  options.RetryBackoff,
+	}, sink.push)
+	return sink, nil
+}
+
+func (self *LokiSink) Write(ctx context.Context, event *Event) error {
+	entry := &lokiEntry{
+		labels:    map[string]string{"job": "timber"},
+		timestamp: event.CreatedAt(),
+		line:      string(event.Payload),
+	}
+	fields := event.Fields()
+	for _, field := range lokiLabelFields {
+		if value, ok := fields[field].(string); ok && value != "" {
+			entry.labels[field] = value
+		}
+	}
+	return self.add(entry, len(entry.line))
+}
+
+// lokiStreams groups the entries by their labels, each stream in time order.
+func lokiStreams(entries []*lokiEntry) *lokiPush {
+	sorted := append([]*lokiEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].timestamp.Before(sorted[j].timestamp)
+	})
+
+	push := &lokiPush{}
+	streams := make(map[string]*lokiStream)
+	for _, entry := range sorted {
+		key := lokiStreamKey(entry.labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: entry.labels}
+			streams[key] = stream
+			push.Streams = append(push.Streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), entry.line})
+	}
+	return push
+}
+
+func lokiStreamKey(labels map[string]string) string {
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := ""
+	for _, name := range names {
+		key += name + "=" + strconv.Quote(labels[name]) + ","
+	}
+	return key
+}
+
+// push sends a batch, and returns it when it is worth trying again because
+// Loki is unreachable, busy or failing.
+func (self *LokiSink) push(batch []interface{}) ([]interface{}, error) {
+	entries := make([]*lokiEntry, len(batch))
+	for i, entry := range batch {
+		entries[i] = entry.(*lokiEntry)
+	}
+	body, err := json.Marshal(lokiStreams(entries))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", self.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if self.options.Username != "" {
+		request.SetBasicAuth(self.options.Username, self.options.Password)
+	}
+	if self.options.TenantID != "" {
+		request.Header.Set("X-Scope-OrgID", self.options.TenantID)
+	}
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		return batch, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 300 {
+		return nil, nil
+	}
+	b, _ := ioutil.ReadAll(response.Body)
+	err = fmt.Errorf("loki responded with %s: %s", response.Status, bytes.TrimSpace(b))
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return batch, err
+	}
+	return nil, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The answer to a push Loki took.
+var lokiPushed = cannedResponse{status: http.StatusNoContent}
+
+func lokiEvent(t *testing.T, fields map[string]string) *Event {
+	fields["created_at"] = "2021-02-19 15:04:05.123 +0000 UTC"
+	event, err := NewEvent(fields)
+	assert.Nil(t, err)
+	return event
+}
+
+func testLokiOptions(url string) LokiOptions {
+	options := DefaultLokiOptions()
+	options.URL = url
+	options.FlushInterval = time.Hour
+	options.RetryBackoff = time.Millisecond
+	return options
+}
+
+func TestLokiSink_GroupsStreamsByLabels(t *testing.T) {
+	server := newRecordingServer(lokiPushed)
+	defer server.Close()
+
+	options := testLokiOptions(server.URL)
+	options.TenantID = "dba"
+	options.Username = "timber"
+	options.Password = "hunter2"
+	sink, err := NewLokiSink(options)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	slowQuery := map[string]string{"type": "timber.postgres_slow_query", "database": "ledger", "shard_name": "shard_1"}
+	slowQuery["query"] = "SELECT 1"
+	assert.Nil(t, sink.Write(ctx, lokiEvent(t, slowQuery)))
+	assert.Nil(t, sink.Write(ctx, lokiEvent(t, map[string]string{"type": "timber.postgres_checkpoint", "shard_name": ""})))
+	slowQuery["query"] = "SELECT 2"
+	assert.Nil(t, sink.Write(ctx, lokiEvent(t, slowQuery)))
+	assert.Nil(t, sink.Close())
+
+	requests, bodies := server.received()
+	assert.Len(t, requests, 1)
+	request := requests[0]
+	assert.Equal(t, "/loki/api/v1/push", request.URL.Path)
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+	assert.Equal(t, "dba", request.Header.Get("X-Scope-OrgID"))
+	username, password, _ := request.BasicAuth()
+	assert.Equal(t, "timber", username)
+	assert.Equal(t, "hunter2", password)
+
+	push := new(lokiPush)
+	assert.Nil(t, json.Unmarshal(bodies[0], push))
+	streams := push.Streams
+	assert.Len(t, streams, 2)
+	assert.Equal(t, map[string]string{"job": "timber", "type": "timber.postgres_slow_query", "database": "ledger", "shard_name": "shard_1"}, streams[0].Stream)
+	assert.Len(t, streams[0].Values, 2)
+	assert.Equal(t, "1613747045123000000", streams[0].Values[0][0])
+	// The query stays in the line instead of becoming a label.
+	assert.Contains(t, streams[0].Values[0][1], `"query":"SELECT 1"`)
+	assert.Contains(t, streams[0].Values[1][1], `"query":"SELECT 2"`)
+
+	// Empty fields are left out of the labels.
+	assert.Equal(t, map[string]string{"job": "timber", "type": "timber.postgres_checkpoint"}, streams[1].Stream)
+}
+
+func TestLokiSink_RetriesFailedPushes(t *testing.T) {
+	server := newRecordingServer(lokiPushed, cannedResponse{status: http.StatusServiceUnavailable}, cannedResponse{status: http.StatusTooManyRequests})
+	defer server.Close()
+
+	sink, err := NewLokiSink(testLokiOptions(server.URL + "/loki/api/v1/push"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Write(context.Background(), lokiEvent(t, map[string]string{"type": "timber.postgres_error"})))
+	assert.Nil(t, sink.Flush())
+	requests, _ := server.received()
+	assert.Len(t, requests, 3)
+	assert.Equal(t, "/loki/api/v1/push", requests[2].URL.Path)
+	assert.Nil(t, sink.Close())
+}
+
+func TestLokiSink_DropsRefusedPushes(t *testing.T) {
+	server := newRecordingServer(lokiPushed, cannedResponse{status: http.StatusBadRequest})
+	defer server.Close()
+
+	sink, err := NewLokiSink(testLokiOptions(server.URL))
+	assert.Nil(t, err)
+
+	// A push Loki refuses would be refused again.
+	assert.Nil(t, sink.Write(context.Background(), lokiEvent(t, map[string]string{"type": "timber.postgres_error"})))
+	assert.NotNil(t, sink.Flush())
+	assert.Nil(t, sink.Close())
+	requests, _ := server.received()
+	assert.Len(t, requests, 1)
+}
+
+func TestLokiSink_SendsFullBatches(t *testing.T) {
+	server := newRecordingServer(lokiPushed)
+	defer server.Close()
+
+	options := testLokiOptions(server.URL)
+	options.BatchSize = 2
+	sink, err := NewLokiSink(options)
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, sink.Write(context.Background(), lokiEvent(t, map[string]string{"type": "timber.postgres_error"})))
+	}
+
+	var requests []*http.Request
+	for deadline := time.Now().Add(2 * time.Second); len(requests) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		requests, _ = server.received()
+	}
+	assert.Len(t, requests, 1)
+}
@@ -5,41 +5,96 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 )
 
-var (
-	RegexBeginningOfLine = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}.*([A-Z]+):`)
-)
-
-func HandlePostgresLogLine(logLine *PostgresLogLine, logger io.Writer) {
+func HandlePostgresLogLine(logLine *PostgresLogLine, sink Sink) {
 	switch logLine.LogType {
 	case "statement", "execute", "parse", "bind":
-		LogSlowQuery(logLine, logger)
+		LogSlowQuery(logLine, sink)
 	case "plan":
-		// NOTHING FOR NOW
+		LogQueryPlan(logLine, sink)
+	case "lock_wait", "deadlock":
+		LogLockEvent(logLine, sink)
+		// A deadlock is an error as well, and is counted with the others.
+		if IsErrorSeverity(logLine.Severity) {
+			LogPostgresError(logLine, sink)
+		}
+	case "checkpoint":
+		LogCheckpoint(logLine, sink)
+	case "autovacuum", "autoanalyze":
+		LogAutovacuum(logLine, sink)
+	case "connection", "disconnection":
+		LogSession(logLine, sink)
+	case "temp_file":
+		LogTempFile(logLine, sink)
+	default:
+		if IsErrorSeverity(logLine.Severity) {
+			LogPostgresError(logLine, sink)
+		}
 	}
 }
 
+// LogParser produces postgres log lines until it returns ErrLogEOF.
+type LogParser interface {
+	Parse() (*PostgresLogLine, error)
+}
+
 type LogScanner interface {
 	Scan() bool
 	Text() string
 	Err() error
 }
 
+// RecordLogScanner is a LogScanner that knows more about each line than its
+// text, like where it is in the source so reading can resume after it.
+type RecordLogScanner interface {
+	LogScanner
+	Record() *LogRecord
+}
+
+// LogRecord is a scanned line along with what its source knows about it.
+type LogRecord struct {
+	Text   string
+	Cursor string
+	Source *SourceMetadata
+}
+
+// SourceMetadata is attached to the messages of the entries it came with. The
+// host name replaces the hostname of the message.
+type SourceMetadata struct {
+	Name      string `json:"source,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	HostName  string `json:"-"`
+	Unit      string `json:"journald_unit,omitempty"`
+	PID       int    `json:"journald_pid,omitempty"`
+	BootID    string `json:"journald_boot_id,omitempty"`
+	Timestamp string `json:"journald_timestamp,omitempty"`
+
+	// The pod and container of container logs.
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	PodUID      string `json:"pod_uid,omitempty"`
+	Container   string `json:"container,omitempty"`
+	ContainerID string `json:"container_id,omitempty"`
+}
+
 func NewStdinLogScanner() LogScanner {
-	return bufio.NewScanner(os.Stdin)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), maxBufferLength)
+	return scanner
 }
 
 type LogLine struct {
-	alive bool
-	line  string
+	alive  bool
+	line   string
+	cursor string
+	source *SourceMetadata
 }
 
 type PostgresLogLine struct {
@@ -50,22 +105,100 @@ type PostgresLogLine struct {
 	LogType       string
 	StatementName string
 	Value         string
+
+	// Populated when the log_line_prefix contains the matching escape.
+	Severity             string
+	PID                  int
+	LineNumber           int
+	SessionID            string
+	ApplicationName      string
+	RemoteHost           string
+	RemotePort           string
+	BackendType          string
+	CommandTag           string
+	SQLState             string
+	VirtualTransactionID string
+	TransactionID        string
+	QueryID              string
+
+	// The message following the severity, and the fields postgres attaches to it.
+	Message       string
+	Detail        string
+	Hint          string
+	Context       string
+	Statement     string
+	QueryPosition int
+
+	// Bind parameters from a "parameters: $1 = '...'" DETAIL.
+	Parameters BindParameters
+
+	// The cursor of the last line of the entry, for logger sources that can
+	// resume after it, like journald and files.
+	Cursor string
+	// What the logger source knows about the first line of the entry, if anything.
+	Source *SourceMetadata
+}
+
+// CreatedAt is when the message for the entry is sent, or when the entry was
+// logged when replaying old logs.
+func (self *PostgresLogLine) CreatedAt() string {
+	if createdAtFromEntry && !self.Timestamp.IsZero() {
+		return self.Timestamp.UTC().String()
+	}
+	return time.Now().UTC().String()
+}
+
+// HostName is the host the entry was logged on when the logger source knows
+// it, or the host timber runs on.
+func (self *PostgresLogLine) HostName() string {
+	if self.Source != nil && self.Source.HostName != "" {
+		return self.Source.HostName
+	}
+	return HostName()
 }
 
 type PostgresLogParser struct {
 	logScanner  LogScanner
+	prefix      *LogLinePrefix
 	buffer      string
 	logLineChan chan *LogLine
+
+	// The pid and line number of the last prefixed line in the buffer, used to
+	// attach continuation lines to the entry that they belong to.
+	bufferPID        int
+	bufferLineNumber int
+
+	// The cursor of the last line in the buffer and the source metadata of the
+	// first, for scanners that have them.
+	bufferCursor string
+	bufferSource *SourceMetadata
+
+	// How long to wait for more lines before parsing the buffer, zero to wait
+	// for the next entry.
+	idleTimeout time.Duration
 }
 
 func NewPostgresLogParser(logScanner LogScanner) *PostgresLogParser {
+	return NewPostgresLogParserWithPrefix(logScanner, MustLogLinePrefix(DefaultLogLinePrefix))
+}
+
+// NewPostgresLogParserWithPrefix is like NewPostgresLogParser but detects and
+// parses log lines written with the given log_line_prefix.
+func NewPostgresLogParserWithPrefix(logScanner LogScanner, prefix *LogLinePrefix) *PostgresLogParser {
 	logLineChan := make(chan *LogLine)
 
 	// Continue to parse the scanner for log lines.
 	// Signal when the scanner has completed.
+	recordScanner, hasRecord := logScanner.(RecordLogScanner)
 	go func() {
 		for logScanner.Scan() {
-			logLineChan <- &LogLine{line: logScanner.Text(), alive: true}
+			logLine := &LogLine{line: logScanner.Text(), alive: true}
+			if hasRecord {
+				record := recordScanner.Record()
+				logLine.cursor = record.Cursor
+				logLine.source = record.Source
+			}
+			logLineChan <- logLine
 		}
 		close(logLineChan)
 	}()
@@ -74,6 +207,8 @@ func NewPostgresLogParser(logScanner LogScanner) *PostgresLogParser {
 		buffer:      "",
 		logLineChan: logLineChan,
 		logScanner:  logScanner,
+		prefix:      prefix,
+		idleTimeout: time.Second,
 	}
 }
 
@@ -85,18 +220,28 @@ var (
 	ErrInvalidLogLine = errors.New("The parser could not derive query or plan info from the log line")
 )
 
-// A postgres log line starts with a "YYYY-MM-DD HH:MM:SS [*] LOG:" pattern.
-// If a line matches that, it's a new postgres log line.
+// A postgres log line starts with the configured log_line_prefix followed by a
+// severity, ie: "YYYY-MM-DD HH:MM:SS TZ [*] LOG:". If a line matches that, it's a new postgres log line.
 // We can continue adding random unmatched newlines to the buffer after detecting
 // a new log line, because postgres log lines can have multiple lines.
 // Lastly, postgres doesn't hesitate when it logs lines, so we can also include a
-// timer to detect the end of a postgres log line.
+// timer to detect the end of a postgres log line. Without an idle timeout an
+// entry ends at the next entry or the end of the log, which suits replaying
+// files that are read at full speed.
 func (self *PostgresLogParser) Parse() (*PostgresLogLine, error) {
-	logTimeout := time.NewTimer(time.Second)
+	var logTimeout *time.Timer
+	var idle <-chan time.Time
+	if self.idleTimeout > 0 {
+		logTimeout = time.NewTimer(self.idleTimeout)
+		defer logTimeout.Stop()
+		idle = logTimeout.C
+	}
 
 	for {
 		// Reset the log line timeout timer.
-		logTimeout.Reset(time.Second)
+		if logTimeout != nil {
+			logTimeout.Reset(self.idleTimeout)
+		}
 
 		// Collect a single log line.
 		select {
@@ -115,22 +260,30 @@ func (self *PostgresLogParser) Parse() (*PostgresLogLine, error) {
 			// If we detect a new log line and we have existing buffer,
 			// then we need to parse the buffer. And reset buffer.
 			rawLine := logLine.line
-			if len(self.buffer) > 0 && isNewLogLine(rawLine) {
+			if len(self.buffer) > 0 && self.prefix.IsNewLogLine(rawLine) && !self.continuesBuffer(rawLine) {
 				// Swap buffer so rawLine can be included next time Parse is called.
 
 				// Time to parse this and return to caller.
 				log, err := self.parseLogBuffer()
 				self.buffer = rawLine
+				self.bufferCursor = logLine.cursor
+				self.bufferSource = logLine.source
+				self.trackBufferLine(rawLine)
 				return log, err
 			}
 
 			// Otherwise, we can continue adding buffer until max buffer size.
-			if len(self.buffer) < maxBufferLength {
+			if len(self.buffer) == 0 {
+				self.buffer = rawLine
+				self.bufferSource = logLine.source
+			} else if len(self.buffer) < maxBufferLength {
 				self.buffer += "\r\n"
 				self.buffer += rawLine
 			}
+			self.bufferCursor = logLine.cursor
+			self.trackBufferLine(rawLine)
 
-		case <-logTimeout.C:
+		case <-idle:
 			if len(self.buffer) == 0 {
 				continue
 			}
@@ -140,49 +293,169 @@ func (self *PostgresLogParser) Parse() (*PostgresLogLine, error) {
 	}
 }
 
+// Postgres writes these as separate lines after the entry they belong to.
+var continuationSeverities = map[string]bool{
+	"DETAIL":    true,
+	"HINT":      true,
+	"CONTEXT":   true,
+	"STATEMENT": true,
+	"QUERY":     true,
+	"LOCATION":  true,
+}
+
+// continuesBuffer reports whether line is a continuation, like a DETAIL, of the
+// buffered entry. The pid and line number have to match when the prefix has them.
+func (self *PostgresLogParser) continuesBuffer(line string) bool {
+	continuation := new(PostgresLogLine)
+	if _, ok := self.prefix.ParseInto(line, continuation); !ok {
+		return false
+	}
+	if !continuationSeverities[continuation.Severity] {
+		return false
+	}
+	if continuation.PID != self.bufferPID {
+		return false
+	}
+	if continuation.LineNumber != 0 &&
+		continuation.LineNumber != self.bufferLineNumber &&
+		continuation.LineNumber != self.bufferLineNumber+1 {
+		return false
+	}
+	return true
+}
+
+func (self *PostgresLogParser) trackBufferLine(line string) {
+	tracked := new(PostgresLogLine)
+	if _, ok := self.prefix.ParseInto(line, tracked); ok {
+		self.bufferPID = tracked.PID
+		self.bufferLineNumber = tracked.LineNumber
+	}
+}
+
 func (self *PostgresLogParser) parseLogBuffer() (*PostgresLogLine, error) {
+	log := &PostgresLogLine{Cursor: self.bufferCursor, Source: self.bufferSource}
+	buffer := self.splitContinuations(self.buffer, log)
+	message, ok := self.prefix.ParseInto(buffer, log)
+	if !ok {
+		message = buffer
+	}
+	self.buffer = ""
+	self.bufferPID = 0
+	self.bufferLineNumber = 0
+
+	log.Message = message
+	err := parseMessage(log)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// splitContinuations stores the DETAIL, HINT, CONTEXT and STATEMENT lines of
+// the buffer on log and returns the rest of the entry.
+func (self *PostgresLogParser) splitContinuations(buffer string, log *PostgresLogLine) string {
+	lines := strings.Split(buffer, "\r\n")
+	sections := make(map[string][]string)
+	severity := ""
+
+	for _, line := range lines[1:] {
+		continuation := new(PostgresLogLine)
+		message, ok := self.prefix.ParseInto(line, continuation)
+		if ok && continuationSeverities[continuation.Severity] {
+			severity = continuation.Severity
+			sections[severity] = append(sections[severity], message)
+			continue
+		}
+		sections[severity] = append(sections[severity], line)
+	}
+
+	log.Detail = strings.Join(sections["DETAIL"], "\r\n")
+	log.Hint = strings.Join(sections["HINT"], "\r\n")
+	log.Context = strings.Join(sections["CONTEXT"], "\r\n")
+	log.Statement = strings.Join(sections["STATEMENT"], "\r\n")
+
+	return strings.Join(append(lines[:1], sections[""]...), "\r\n")
+}
+
+// parseMessage fills in what timber derives from the message and detail of an
+// entry. Entries that timber has no use for return ErrInvalidLogLine.
+func parseMessage(log *PostgresLogLine) error {
+	log.Parameters = ParseBindParameters(log.Detail)
+
+	if logType := lockEventLogType(log); logType != "" {
+		log.LogType = logType
+		return nil
+	}
+	if logType := maintenanceLogType(log); logType != "" {
+		log.LogType = logType
+		return nil
+	}
+	if logType := sessionLogType(log); logType != "" {
+		log.LogType = logType
+		return nil
+	}
+	if logType := tempFileLogType(log); logType != "" {
+		log.LogType = logType
+		return nil
+	}
+	if IsErrorSeverity(log.Severity) {
+		return nil
+	}
+	return parseDurationMessage(log)
+}
+
+// parseDurationMessage fills the duration, log type, statement name and value
+// from a "duration: N ms  type name: value" message.
+func parseDurationMessage(log *PostgresLogLine) error {
+	message := log.Message
+
 	// Parse Duration
-	index := strings.Index(self.buffer, "duration: ")
+	index := strings.Index(message, "duration: ")
 	if index < 0 {
-		self.buffer = ""
-		return nil, ErrInvalidLogLine
+		return ErrInvalidLogLine
 	}
-	durationEtc := self.buffer[index:]
+	durationEtc := message[index:]
 	durationEndIndex := strings.Index(durationEtc, " ms")
 	if durationEndIndex < 0 {
-		self.buffer = ""
-		return nil, ErrInvalidLogLine
+		return ErrInvalidLogLine
 	}
 	durationEndIndex += index
 	duration, _ := time.ParseDuration(
 		fmt.Sprint(
-			strings.Replace(self.buffer[index:durationEndIndex], "duration: ", "", 1),
+			strings.Replace(message[index:durationEndIndex], "duration: ", "", 1),
 			"ms"))
 
-	timestamp := parseTime(self.buffer)
-	user, database := parseUserAndDatabase(self.buffer)
-	logType, statementName := parseLogTypeWithStatementName(self.buffer)
-	value := parseValueFromBuffer(self.buffer)
-
-	log := &PostgresLogLine{
-		Timestamp:     timestamp,
-		Username:      user,
-		Database:      database,
-		Duration:      duration,
-		LogType:       logType,
-		StatementName: statementName,
-		Value:         value,
+	if !strings.Contains(message, " ms  ") {
+		return ErrInvalidLogLine
 	}
 
-	self.buffer = ""
-	return log, nil
+	log.Duration = duration
+	log.LogType, log.StatementName = parseLogTypeWithStatementName(message)
+	log.Value = parseValueFromBuffer(message)
+	return nil
 }
 
-// Parse Time
-func parseTime(buffer string) time.Time {
-	timeStr := strings.Split(buffer, " [")[0]
-	timestamp, _ := time.Parse("2006-01-02 15:04:05 MST", timeStr)
-	return timestamp
+// BindParameters are the values of a prepared statement's parameters, keyed by
+// placeholder (ie: "$1"). Values are kept as postgres wrote them, so strings are
+// quoted and nulls are NULL.
+type BindParameters map[string]string
+
+var RegexBindParameter = regexp.MustCompile(`\$(\d+) = ('(?:[^']|'')*'|NULL)`)
+
+// ParseBindParameters parses a "parameters: $1 = '...', $2 = '...'" detail.
+func ParseBindParameters(detail string) BindParameters {
+	if !strings.HasPrefix(detail, "parameters: ") {
+		return nil
+	}
+
+	params := make(BindParameters)
+	for _, match := range RegexBindParameter.FindAllStringSubmatch(detail, -1) {
+		params["$"+match[1]] = match[2]
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
 }
 
 // Parse Log Type w/ StatementName
@@ -199,41 +472,46 @@ func parseLogTypeWithStatementName(buffer string) (string, string) {
 // Parse value from buffer
 func parseValueFromBuffer(buffer string) string {
 	partial := strings.Split(buffer, " ms  ")[1]
+
+	// auto_explain writes the plan on the lines following "plan:".
+	if strings.HasPrefix(partial, "plan:") {
+		return strings.TrimLeft(partial[len("plan:"):], " \t\r\n")
+	}
+
 	index := strings.Index(partial, ": ")
-	value := strings.SplitN(partial, ":", 2)[1]
+	value := ""
 	if index > 0 {
 		value = strings.SplitN(partial, ": ", 2)[1]
+	} else if parts := strings.SplitN(partial, ":", 2); len(parts) > 1 {
+		value = parts[1]
 	}
 	return value
 }
 
-// Parse User and Database
-func parseUserAndDatabase(buffer string) (string, string) {
-	index := strings.Index(buffer, " LOG:")
-	if index < 0 {
-		return "", ""
-	}
-	splitsUpToUserAndDatabase := strings.Split(buffer[:index], " ")
-	userAndDatabaseStr := splitsUpToUserAndDatabase[len(splitsUpToUserAndDatabase)-1]
-	userAndDatabase := strings.Split(userAndDatabaseStr, "@")
-	user := userAndDatabase[0]
-	database := userAndDatabase[1]
-	return user, database
-}
-
-func isNewLogLine(line string) bool {
-	return RegexBeginningOfLine.MatchString(line)
-}
-
 var (
+	configPath       string
 	loggerSourceType string
+	filePath         string
+	fileStatePath    string
+	inputFormat      string
+	logLinePrefix    string
 	tcpOutUrl        string
+	sinkSpecs        []string
 	displayVersion   bool
 
+	sessionCountInterval time.Duration
+
+	// Set when replaying, so messages are dated by their entries.
+	createdAtFromEntry bool
+
+	journaldOptions = DefaultJournaldOptions()
+	syslogOptions   = DefaultSyslogOptions()
+
+	statementStatsOptions = DefaultStatementStatsOptions()
+
 	hostname string = ""
 
-	version   string = "0.0.8"
-	tcpLogger *TCPLogger
+	version string = "0.0.8"
 )
 
 // If we add more options, change this into a configuration object.
@@ -246,9 +524,52 @@ func HostName() string {
 	return hostname
 }
 
+// stringListFlag collects the values of a flag that can be repeated.
+type stringListFlag []string
+
+func (self *stringListFlag) String() string {
+	if self == nil {
+		return ""
+	}
+	return strings.Join(*self, ",")
+}
+
+func (self *stringListFlag) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
 func main() {
-	flag.StringVar(&loggerSourceType, "logger-source-type", "stdin", "supports stdin for piped input and journald")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMain(os.Args[2:])
+		return
+	}
+
+	flag.StringVar(&configPath, "config", "", "if set, will read several named sources from this json config file instead of the logger source flags")
+	flag.StringVar(&loggerSourceType, "logger-source-type", "stdin", "supports stdin for piped input, journald, file, container and syslog")
+	flag.StringVar(&filePath, "file-path", "", "the path or glob of the log files to follow with the file and container logger sources")
+	flag.StringVar(&fileStatePath, "file-state-path", "", "if set, will save the offset of the last processed entry of each followed log file here and resume after it")
+	flag.StringVar(&journaldOptions.JournalctlPath, "journalctl-path", journaldOptions.JournalctlPath, "the journalctl binary used by the journald logger source")
+	flag.StringVar(&journaldOptions.CursorPath, "journald-cursor-path", "", "if set, will save the journald cursor of the last processed entry here and resume after it")
+	flag.StringVar(&journaldOptions.Directory, "journald-directory", "", "if set, will read the journal files in this directory instead of the system journal")
+	flag.Var((*stringListFlag)(&journaldOptions.Files), "journald-file", "if set, will read this exported journal file from the beginning and stop at its end, can be repeated")
+	flag.StringVar(&journaldOptions.Identifier, "journald-identifier", journaldOptions.Identifier, "the syslog identifier of the postgres journal entries, empty to match any")
+	flag.Var((*stringListFlag)(&journaldOptions.Matches), "journald-match", "a FIELD=value match on the postgres journal entries, can be repeated")
+	flag.Var((*stringListFlag)(&journaldOptions.Units), "journald-unit", "the systemd unit of the postgres journal entries, can be repeated")
+	flag.StringVar(&inputFormat, "input-format", "stderr", "supports stderr for the plain postgres log, csv for csvlog and json for jsonlog")
+	flag.StringVar(&logLinePrefix, "log-line-prefix", DefaultLogLinePrefix, "the log_line_prefix from postgresql.conf used to parse log lines")
+	flag.StringVar(&statementStatsOptions.PsqlPath, "psql-path", statementStatsOptions.PsqlPath, "the psql binary used to poll pg_stat_statements")
+	flag.StringVar(&statementStatsOptions.ConnectionString, "statement-stats-connection", "", "the connection string or URI used to poll pg_stat_statements, ie: \"host=/var/run/postgresql dbname=postgres\"")
+	flag.DurationVar(&statementStatsOptions.Interval, "statement-stats-interval", 0, "if set, will send the pg_stat_statements deltas of every statement at this interval")
+	flag.StringVar(&syslogOptions.Identifier, "syslog-identifier", syslogOptions.Identifier, "the syslog app name or tag of the postgres messages, empty to match any")
+	flag.StringVar(&syslogOptions.TCPAddr, "syslog-tcp-addr", "", "the address the syslog logger source listens on for TCP, ie: :514")
+	flag.StringVar(&syslogOptions.UDPAddr, "syslog-udp-addr", "", "the address the syslog logger source listens on for UDP, ie: :514")
 	flag.StringVar(&tcpOutUrl, "tcp-out-url", "", "if set, will set up a log sink to given tcp destination")
+	addSinkFlags(flag.CommandLine)
+	flag.IntVar(&durationSampling.MinDurationStatement, "log-min-duration-statement", -1, "the log_min_duration_statement from postgresql.conf in milliseconds, used to derive the sample rate")
+	flag.IntVar(&durationSampling.MinDurationSample, "log-min-duration-sample", -1, "the log_min_duration_sample from postgresql.conf in milliseconds, used to derive the sample rate")
+	flag.Float64Var(&durationSampling.StatementSampleRate, "log-statement-sample-rate", 1.0, "the log_statement_sample_rate from postgresql.conf")
+	flag.DurationVar(&sessionCountInterval, "session-count-interval", 0, "if set, will send connection counts by user and database at this interval")
 	flag.BoolVar(&displayVersion, "version", false, "show the version and exit")
 	flag.Parse()
 
@@ -259,58 +580,102 @@ func main() {
 		return
 	}
 
-	var logScanner LogScanner
-	var err error
-
-	switch loggerSourceType {
-	case "journald":
-		logScanner, err = NewJournaldLogScanner()
+	sourceConfigs := []SourceConfig{{
+		LoggerSourceType: loggerSourceType,
+		InputFormat:      inputFormat,
+		LogLinePrefix:    logLinePrefix,
+		FilePath:         filePath,
+		FileStatePath:    fileStatePath,
+		Journald:         journaldOptions,
+		Syslog:           syslogOptions,
+	}}
+	if configPath != "" {
+		var err error
+		sourceConfigs, err = LoadSourceConfigs(configPath)
 		if err != nil {
-			fmt.Println("Could not start the journald logger source:", err)
+			fmt.Println("Could not load the config:", err)
 			return
 		}
-	case "stdin":
-		logScanner = NewStdinLogScanner()
-	default:
-		fmt.Println("Uknown logger source type:", loggerSourceType)
-		return
 	}
 
-	if tcpOutUrl != "" {
-		log.Println("Creating TCPLogger...")
-		conn, err := net.Dial("tcp", tcpOutUrl)
+	sources := []*Source{}
+	for _, config := range sourceConfigs {
+		source, err := OpenSource(config)
 		if err != nil {
-			panic(err)
+			fmt.Println("Could not start source", config.Name+":", err)
+			for _, opened := range sources {
+				opened.Close()
+			}
+			return
 		}
+		sources = append(sources, source)
 
-		logger := NewTCPLogger(conn, 10)
-		tcpLogger = &logger
-		if err != nil {
-			panic(err)
+		// Stop the source on shutdown so its offsets or cursor are saved. Stdin
+		// is left to end with the process.
+		if source.closer != nil {
+			closeOnSignal(source)
 		}
-		tcpLogger.Start()
-		defer tcpLogger.Close()
 	}
 
-	logParser := NewPostgresLogParser(logScanner)
-	for {
-		pgLogLine, err := logParser.Parse()
-		if err == ErrLogEOF {
-			return
-		}
-		if err == ErrInvalidLogLine {
-			fmt.Println("Skipping log line:", err)
-			continue
-		}
-		if err != nil {
-			fmt.Println("Error parsing postgres log:", err)
-			continue
+	output, err := OpenSinks(sinkSpecs, tcpOutUrl)
+	if err != nil {
+		fmt.Println("Could not open the sinks:", err)
+		for _, source := range sources {
+			source.Close()
 		}
+		return
+	}
+	defer output.Close()
 
-		if tcpOutUrl != "" {
-			HandlePostgresLogLine(pgLogLine, tcpLogger)
-		} else {
-			HandlePostgresLogLine(pgLogLine, nil)
+	if sessionCountInterval > 0 {
+		sessionCounter = NewSessionCounter(sessionCountInterval)
+		sessionCounter.Start(output)
+	}
+
+	if statementStatsOptions.Interval > 0 {
+		poller, err := NewStatementStatsPoller(statementStatsOptions)
+		if err != nil {
+			fmt.Println("Could not poll pg_stat_statements:", err)
+			return
 		}
+		poller.Start(output)
 	}
+
+	RunSources(sources, output)
+}
+
+// addSinkFlags adds the flags that choose and configure the sinks.
+func addSinkFlags(flags *flag.FlagSet) {
+	flags.Var((*stringListFlag)(&sinkSpecs), "sink", "where to send messages: stdout, syslog, tcp:HOST:PORT, elasticsearch:URL, opensearch:URL, loki:URL or otlp:URL, can be repeated (default syslog and stdout, or the -tcp-out-url and stdout)")
+	flags.StringVar(&elasticsearchOptions.APIKey, "elasticsearch-api-key", "", "if set, will authenticate to elasticsearch with this API key")
+	flags.IntVar(&elasticsearchOptions.BatchSize, "elasticsearch-batch-size", elasticsearchOptions.BatchSize, "the most messages sent to elasticsearch in one bulk request")
+	flags.DurationVar(&elasticsearchOptions.FlushInterval, "elasticsearch-flush-interval", elasticsearchOptions.FlushInterval, "how often to send the messages queued for elasticsearch")
+	flags.StringVar(&elasticsearchOptions.IndexPattern, "elasticsearch-index", elasticsearchOptions.IndexPattern, "the elasticsearch index, %Y, %m, %d and %H are replaced by the date of each message")
+	flags.StringVar(&elasticsearchOptions.Password, "elasticsearch-password", "", "the password of the -elasticsearch-username")
+	flags.StringVar(&elasticsearchOptions.Username, "elasticsearch-username", "", "if set, will authenticate to elasticsearch with basic auth")
+	flags.IntVar(&lokiOptions.BatchSize, "loki-batch-size", lokiOptions.BatchSize, "the most messages pushed to loki at once")
+	flags.DurationVar(&lokiOptions.FlushInterval, "loki-flush-interval", lokiOptions.FlushInterval, "how often to push the messages queued for loki")
+	flags.StringVar(&lokiOptions.Password, "loki-password", "", "the password of the -loki-username")
+	flags.StringVar(&lokiOptions.TenantID, "loki-tenant-id", "", "if set, will push to this tenant of a multi-tenant loki")
+	flags.StringVar(&lokiOptions.Username, "loki-username", "", "if set, will authenticate to loki with basic auth")
+	flags.IntVar(&otlpOptions.BatchSize, "otlp-batch-size", otlpOptions.BatchSize, "the most log records exported with otlp at once")
+	flags.DurationVar(&otlpOptions.FlushInterval, "otlp-flush-interval", otlpOptions.FlushInterval, "how often to export the messages queued for otlp")
+	flags.Var(headerFlag(otlpOptions.Headers), "otlp-header", "a KEY=VALUE header sent to the otlp collector, can be repeated")
+	flags.BoolVar(&tcpSinkTLSOptions.Enabled, "tcp-out-tls", false, "if set, will connect to the tcp destination over TLS, which the other -tcp-out-tls flags also do")
+	flags.StringVar(&tcpSinkTLSOptions.CAPath, "tcp-out-tls-ca", "", "a PEM bundle of the CAs that verify the tcp destination, instead of the system ones")
+	flags.StringVar(&tcpSinkTLSOptions.CertPath, "tcp-out-tls-cert", "", "a PEM client certificate for tcp destinations that require one")
+	flags.StringVar(&tcpSinkTLSOptions.KeyPath, "tcp-out-tls-key", "", "the PEM key of the -tcp-out-tls-cert")
+	flags.StringVar(&tcpSinkTLSOptions.MinVersion, "tcp-out-tls-min-version", tcpSinkTLSOptions.MinVersion, "the lowest TLS version to connect with, 1.0 to 1.3")
+	flags.StringVar(&tcpSinkTLSOptions.ServerName, "tcp-out-tls-server-name", "", "if set, will verify the tcp destination as this name instead of its host")
+}
+
+// closeOnSignal closes the logger source on SIGINT or SIGTERM, which ends its
+// loop once the source has stopped.
+func closeOnSignal(source interface{ Close() }) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		source.Close()
+	}()
 }
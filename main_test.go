@@ -146,3 +146,43 @@ func TestScrubbingCanFilterSchemaName(t *testing.T) {
 	//TODO: Make this not strip the shard information.
 	assert.Equal(t, `SELECT * FROM abacus101_shard6.transactions WHERE balance = 'xxx'`, scrubbedQuery)
 }
+
+func TestParsingBindParametersFromDetail(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [56193-3/9939-5708] postgres@baller_test LOG:  duration: 0.020 ms  execute <unnamed>: SELECT 1 AS one FROM "borrower_applications" WHERE "borrower_applications"."confirmation_number" = $1 LIMIT $2
+2021-01-11 15:25:36 EST [56193-3/9939-5709] postgres@baller_test DETAIL:  parameters: $1 = '6BE8-BC52-7545', $2 = NULL, $3 = 'it''s'
+2021-01-11 15:25:37 EST [56194-4/12-10] postgres@baller_test LOG:  duration: 1.020 ms  statement: SELECT 2
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "execute", pgLog.LogType)
+	assert.Equal(t, `SELECT 1 AS one FROM "borrower_applications" WHERE "borrower_applications"."confirmation_number" = $1 LIMIT $2`, pgLog.Value)
+	assert.Equal(t, `parameters: $1 = '6BE8-BC52-7545', $2 = NULL, $3 = 'it''s'`, pgLog.Detail)
+	assert.Equal(t, BindParameters{"$1": `'6BE8-BC52-7545'`, "$2": "NULL", "$3": `'it''s'`}, pgLog.Parameters)
+
+	// The next entry is not swallowed by the previous one.
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT 2", pgLog.Value)
+	assert.Nil(t, pgLog.Parameters)
+}
+
+func TestParsingContinuationFromAnotherBackend(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [56193-3/9939-5708] postgres@baller_test LOG:  duration: 0.020 ms  execute <unnamed>: SELECT $1
+2021-01-11 15:25:36 EST [77777-5/1-3] postgres@baller_test DETAIL:  parameters: $1 = 'other'
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "SELECT $1", pgLog.Value)
+	assert.Equal(t, "", pgLog.Detail)
+	assert.Nil(t, pgLog.Parameters)
+
+	// The other backend's DETAIL is parsed on its own and has no duration.
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrInvalidLogLine, err)
+}
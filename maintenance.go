@@ -0,0 +1,194 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	RegexCheckpointComplete = regexp.MustCompile(`^(checkpoint|restartpoint) complete: `)
+	RegexCheckpointBuffers  = regexp.MustCompile(`wrote (\d+) buffers \(([\d.]+)%\)`)
+	RegexCheckpointWALFiles = regexp.MustCompile(`(\d+) (?:WAL|transaction log) file\(s\) added, (\d+) removed, (\d+) recycled`)
+	RegexCheckpointTimes    = regexp.MustCompile(`write=([\d.]+) s, sync=([\d.]+) s, total=([\d.]+) s`)
+	RegexCheckpointSync     = regexp.MustCompile(`sync files=(\d+), longest=([\d.]+) s, average=([\d.]+) s`)
+	RegexCheckpointDistance = regexp.MustCompile(`distance=(\d+) kB, estimate=(\d+) kB`)
+
+	// ie: `automatic aggressive vacuum to prevent wraparound of table "db.public.accounts": index scans: 1`
+	RegexAutovacuum           = regexp.MustCompile(`^automatic (aggressive )?(vacuum|analyze) (to prevent wraparound )?of table "([^"]+)"`)
+	RegexAutovacuumIndexScans = regexp.MustCompile(`index scans: (\d+)`)
+	RegexAutovacuumPages      = regexp.MustCompile(`pages: (\d+) removed, (\d+) remain`)
+	RegexAutovacuumTuples     = regexp.MustCompile(`tuples: (\d+) removed, (\d+) remain, (\d+) are dead but not yet removable`)
+	RegexAutovacuumBuffers    = regexp.MustCompile(`buffer usage: (\d+) hits, (\d+) (?:misses|reads), (\d+) dirtied`)
+	RegexAutovacuumRates      = regexp.MustCompile(`avg read rate: ([\d.]+) MB/s, avg write rate: ([\d.]+) MB/s`)
+	RegexAutovacuumWAL        = regexp.MustCompile(`WAL usage: (\d+) records, (\d+) full page images, (\d+) bytes`)
+	RegexAutovacuumCPU        = regexp.MustCompile(`CPU: user: ([\d.]+) s, system: ([\d.]+) s, elapsed: ([\d.]+) s`)
+)
+
+// maintenanceLogType returns "checkpoint", "autovacuum" or "autoanalyze" for
+// the entries written by log_checkpoints and log_autovacuum_min_duration, or
+// an empty string for anything else.
+func maintenanceLogType(logLine *PostgresLogLine) string {
+	if RegexCheckpointComplete.MatchString(logLine.Message) {
+		return "checkpoint"
+	}
+	if match := RegexAutovacuum.FindStringSubmatch(logLine.Message); match != nil {
+		return "auto" + match[2]
+	}
+	return ""
+}
+
+// submatchFloats returns the submatches of the first match of regex as floats,
+// or zeros when there is no match.
+func submatchFloats(regex *regexp.Regexp, s string) []float64 {
+	values := make([]float64, regex.NumSubexp())
+	match := regex.FindStringSubmatch(s)
+	if match == nil {
+		return values
+	}
+	for i := range values {
+		values[i], _ = strconv.ParseFloat(match[i+1], 64)
+	}
+	return values
+}
+
+type CheckpointMessage struct {
+	Kind                     string  `json:"kind"`
+	BuffersWritten           int64   `json:"buffers_written"`
+	BuffersWrittenPercent    float64 `json:"buffers_written_percent"`
+	WALFilesAdded            int64   `json:"wal_files_added"`
+	WALFilesRemoved          int64   `json:"wal_files_removed"`
+	WALFilesRecycled         int64   `json:"wal_files_recycled"`
+	WriteTimeInSeconds       float64 `json:"write_time_in_seconds"`
+	SyncTimeInSeconds        float64 `json:"sync_time_in_seconds"`
+	TotalTimeInSeconds       float64 `json:"total_time_in_seconds"`
+	SyncFiles                int64   `json:"sync_files"`
+	LongestSyncTimeInSeconds float64 `json:"longest_sync_time_in_seconds"`
+	AverageSyncTimeInSeconds float64 `json:"average_sync_time_in_seconds"`
+	DistanceInKilobytes      int64   `json:"distance_in_kilobytes"`
+	EstimateInKilobytes      int64   `json:"estimate_in_kilobytes"`
+	CreatedAt                string  `json:"created_at"`
+	Type                     string  `json:"type"`
+	HostName                 string  `json:"hostname"`
+	TimberVersion            string  `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// ParseCheckpoint parses a "checkpoint complete: wrote N buffers ..." entry.
+func ParseCheckpoint(logLine *PostgresLogLine) *CheckpointMessage {
+	message := logLine.Message
+	buffers := submatchFloats(RegexCheckpointBuffers, message)
+	walFiles := submatchFloats(RegexCheckpointWALFiles, message)
+	times := submatchFloats(RegexCheckpointTimes, message)
+	sync := submatchFloats(RegexCheckpointSync, message)
+	distance := submatchFloats(RegexCheckpointDistance, message)
+
+	return &CheckpointMessage{
+		Kind:                     strings.Fields(message)[0],
+		BuffersWritten:           int64(buffers[0]),
+		BuffersWrittenPercent:    buffers[1],
+		WALFilesAdded:            int64(walFiles[0]),
+		WALFilesRemoved:          int64(walFiles[1]),
+		WALFilesRecycled:         int64(walFiles[2]),
+		WriteTimeInSeconds:       times[0],
+		SyncTimeInSeconds:        times[1],
+		TotalTimeInSeconds:       times[2],
+		SyncFiles:                int64(sync[0]),
+		LongestSyncTimeInSeconds: sync[1],
+		AverageSyncTimeInSeconds: sync[2],
+		DistanceInKilobytes:      int64(distance[0]),
+		EstimateInKilobytes:      int64(distance[1]),
+		CreatedAt:                logLine.CreatedAt(),
+		Type:                     "timber.postgres_checkpoint",
+		HostName:                 logLine.HostName(),
+		TimberVersion:            TimberVersion(),
+		SourceMetadata:           logLine.Source,
+	}
+}
+
+type AutovacuumMessage struct {
+	Operation                  string  `json:"operation"`
+	Aggressive                 bool    `json:"aggressive"`
+	ToPreventWraparound        bool    `json:"to_prevent_wraparound"`
+	Database                   string  `json:"database"`
+	ShardName                  string  `json:"shard_name"`
+	TableName                  string  `json:"table_name"`
+	IndexScans                 int64   `json:"index_scans"`
+	PagesRemoved               int64   `json:"pages_removed"`
+	PagesRemaining             int64   `json:"pages_remaining"`
+	TuplesRemoved              int64   `json:"tuples_removed"`
+	TuplesRemaining            int64   `json:"tuples_remaining"`
+	TuplesDeadNotYetRemovable  int64   `json:"tuples_dead_not_yet_removable"`
+	BufferHits                 int64   `json:"buffer_hits"`
+	BufferMisses               int64   `json:"buffer_misses"`
+	BufferDirtied              int64   `json:"buffer_dirtied"`
+	AverageReadRateInMBPerSec  float64 `json:"average_read_rate_in_mb_per_sec"`
+	AverageWriteRateInMBPerSec float64 `json:"average_write_rate_in_mb_per_sec"`
+	WALRecords                 int64   `json:"wal_records"`
+	WALFullPageImages          int64   `json:"wal_full_page_images"`
+	WALBytes                   int64   `json:"wal_bytes"`
+	CPUUserTimeInSeconds       float64 `json:"cpu_user_time_in_seconds"`
+	CPUSystemTimeInSeconds     float64 `json:"cpu_system_time_in_seconds"`
+	ElapsedTimeInSeconds       float64 `json:"elapsed_time_in_seconds"`
+	CreatedAt                  string  `json:"created_at"`
+	Type                       string  `json:"type"`
+	HostName                   string  `json:"hostname"`
+	TimberVersion              string  `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// ParseAutovacuum parses an "automatic vacuum of table ..." or "automatic
+// analyze of table ..." entry. The statistics follow on indented lines.
+func ParseAutovacuum(logLine *PostgresLogLine) *AutovacuumMessage {
+	message := logLine.Message
+	msg := &AutovacuumMessage{
+		CreatedAt:      logLine.CreatedAt(),
+		HostName:       logLine.HostName(),
+		TimberVersion:  TimberVersion(),
+		SourceMetadata: logLine.Source,
+	}
+
+	match := RegexAutovacuum.FindStringSubmatch(message)
+	if match != nil {
+		msg.Operation = match[2]
+		msg.Aggressive = match[1] != ""
+		msg.ToPreventWraparound = match[3] != ""
+
+		// The table is written as "database.schema.table". Our shards are schemas.
+		names := strings.SplitN(match[4], ".", 3)
+		if len(names) == 3 {
+			msg.Database, msg.ShardName, msg.TableName = names[0], names[1], names[2]
+		} else {
+			msg.TableName = match[4]
+		}
+	}
+	msg.Type = "timber.postgres_auto" + msg.Operation
+
+	indexScans := submatchFloats(RegexAutovacuumIndexScans, message)
+	pages := submatchFloats(RegexAutovacuumPages, message)
+	tuples := submatchFloats(RegexAutovacuumTuples, message)
+	buffers := submatchFloats(RegexAutovacuumBuffers, message)
+	rates := submatchFloats(RegexAutovacuumRates, message)
+	wal := submatchFloats(RegexAutovacuumWAL, message)
+	cpu := submatchFloats(RegexAutovacuumCPU, message)
+
+	msg.IndexScans = int64(indexScans[0])
+	msg.PagesRemoved, msg.PagesRemaining = int64(pages[0]), int64(pages[1])
+	msg.TuplesRemoved, msg.TuplesRemaining, msg.TuplesDeadNotYetRemovable = int64(tuples[0]), int64(tuples[1]), int64(tuples[2])
+	msg.BufferHits, msg.BufferMisses, msg.BufferDirtied = int64(buffers[0]), int64(buffers[1]), int64(buffers[2])
+	msg.AverageReadRateInMBPerSec, msg.AverageWriteRateInMBPerSec = rates[0], rates[1]
+	msg.WALRecords, msg.WALFullPageImages, msg.WALBytes = int64(wal[0]), int64(wal[1]), int64(wal[2])
+	msg.CPUUserTimeInSeconds, msg.CPUSystemTimeInSeconds, msg.ElapsedTimeInSeconds = cpu[0], cpu[1], cpu[2]
+
+	return msg
+}
+
+func LogCheckpoint(logLine *PostgresLogLine, sink Sink) {
+	SendMessage(ParseCheckpoint(logLine), sink)
+}
+
+func LogAutovacuum(logLine *PostgresLogLine, sink Sink) {
+	SendMessage(ParseAutovacuum(logLine), sink)
+}
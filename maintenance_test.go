@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingCheckpoint(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [835972--12] LOG:  checkpoint complete: wrote 1234 buffers (7.5%); 0 WAL file(s) added, 2 removed, 3 recycled; write=269.961 s, sync=0.012 s, total=270.001 s; sync files=42, longest=0.004 s, average=0.001 s; distance=65536 kB, estimate=70000 kB
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "checkpoint", pgLog.LogType)
+
+	msg := ParseCheckpoint(pgLog)
+	assert.Equal(t, "timber.postgres_checkpoint", msg.Type)
+	assert.Equal(t, "checkpoint", msg.Kind)
+	assert.Equal(t, int64(1234), msg.BuffersWritten)
+	assert.Equal(t, 7.5, msg.BuffersWrittenPercent)
+	assert.Equal(t, int64(0), msg.WALFilesAdded)
+	assert.Equal(t, int64(2), msg.WALFilesRemoved)
+	assert.Equal(t, int64(3), msg.WALFilesRecycled)
+	assert.Equal(t, 269.961, msg.WriteTimeInSeconds)
+	assert.Equal(t, 0.012, msg.SyncTimeInSeconds)
+	assert.Equal(t, 270.001, msg.TotalTimeInSeconds)
+	assert.Equal(t, int64(42), msg.SyncFiles)
+	assert.Equal(t, 0.004, msg.LongestSyncTimeInSeconds)
+	assert.Equal(t, int64(65536), msg.DistanceInKilobytes)
+	assert.Equal(t, int64(70000), msg.EstimateInKilobytes)
+}
+
+func TestParsingAutovacuum(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [835990--1] LOG:  automatic aggressive vacuum of table "ledger.abacus3_qa.transactions": index scans: 1
+	pages: 10 removed, 1234 remain, 0 skipped due to pins, 0 skipped frozen
+	tuples: 100 removed, 5000 remain, 7 are dead but not yet removable, oldest xmin: 12345
+	buffer usage: 500 hits, 20 misses, 10 dirtied
+	avg read rate: 1.234 MB/s, avg write rate: 0.617 MB/s
+	WAL usage: 30 records, 2 full page images, 4096 bytes
+	system usage: CPU: user: 0.01 s, system: 0.02 s, elapsed: 0.12 s
+2021-01-11 15:25:37 EST [835991--1] LOG:  automatic analyze of table "ledger.abacus3_qa.users" system usage: CPU: user: 0.03 s, system: 0.00 s, elapsed: 0.05 s
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "autovacuum", pgLog.LogType)
+
+	msg := ParseAutovacuum(pgLog)
+	assert.Equal(t, "timber.postgres_autovacuum", msg.Type)
+	assert.Equal(t, "vacuum", msg.Operation)
+	assert.True(t, msg.Aggressive)
+	assert.False(t, msg.ToPreventWraparound)
+	assert.Equal(t, "ledger", msg.Database)
+	assert.Equal(t, "abacus3_qa", msg.ShardName)
+	assert.Equal(t, "transactions", msg.TableName)
+	assert.Equal(t, int64(1), msg.IndexScans)
+	assert.Equal(t, int64(10), msg.PagesRemoved)
+	assert.Equal(t, int64(1234), msg.PagesRemaining)
+	assert.Equal(t, int64(100), msg.TuplesRemoved)
+	assert.Equal(t, int64(5000), msg.TuplesRemaining)
+	assert.Equal(t, int64(7), msg.TuplesDeadNotYetRemovable)
+	assert.Equal(t, int64(500), msg.BufferHits)
+	assert.Equal(t, int64(20), msg.BufferMisses)
+	assert.Equal(t, int64(10), msg.BufferDirtied)
+	assert.Equal(t, 1.234, msg.AverageReadRateInMBPerSec)
+	assert.Equal(t, int64(4096), msg.WALBytes)
+	assert.Equal(t, 0.02, msg.CPUSystemTimeInSeconds)
+	assert.Equal(t, 0.12, msg.ElapsedTimeInSeconds)
+
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "autoanalyze", pgLog.LogType)
+
+	msg = ParseAutovacuum(pgLog)
+	assert.Equal(t, "timber.postgres_autoanalyze", msg.Type)
+	assert.Equal(t, "analyze", msg.Operation)
+	assert.Equal(t, "users", msg.TableName)
+	assert.Equal(t, 0.05, msg.ElapsedTimeInSeconds)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OTLPOptions struct {
+	// The OTLP/HTTP endpoint of a collector, ie: "http://otel-collector:4318".
+	Endpoint string
+	// Sent with every request, ie: for authentication.
+	Headers map[string]string
+	// A batch is exported once it has this many messages, or once the flush
+	// interval has passed.
+	BatchSize     int
+	FlushInterval time.Duration
+	// How many times an export that failed is tried again, waiting
+	// RetryBackoff longer each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func DefaultOTLPOptions() OTLPOptions {
+	return OTLPOptions{
+		Headers:       make(map[string]string),
+		BatchSize:     500,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    3,
+		RetryBackoff:  time.Second,
+	}
+}
+
+// Set by flags for every otlp sink.
+var otlpOptions = DefaultOTLPOptions()
+
+func init() {
+	RegisterSink("otlp", func(target string) (Sink, error) {
+		options := otlpOptions
+		options.Endpoint = target
+		return NewOTLPSink(options)
+	})
+}
+
+// headerFlag collects KEY=VALUE headers from a flag that can be repeated.
+type headerFlag map[string]string
+
+func (self headerFlag) String() string {
+	headers := []string{}
+	for key, value := range self {
+		headers = append(headers, key+"="+value)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ",")
+}
+
+func (self headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not KEY=VALUE", value)
+	}
+	self[parts[0]] = parts[1]
+	return nil
+}
+
+// The OpenTelemetry semantic conventions for the fields timber messages share.
+var otlpAttributeNames = map[string]string{
+	"database": "db.name",
+	"username": "db.user",
+	"query":    "db.statement",
+}
+
+// The severity numbers of the postgres severities worse than a LOG.
+var otlpSeverityNumbers = map[string]int{
+	"WARNING": 13,
+	"ERROR":   17,
+	"FATAL":   21,
+	"PANIC":   24,
+}
+
+const otlpSeverityInfo = 9
+
+// otlpRecord is a message waiting to be exported.
+type otlpRecord struct {
+	hostName      string
+	timberVersion string
+	timestamp     time.Time
+	observed      time.Time
+	severity      string
+	body          string
+	attributes    []otlpAttribute
+}
+
+type otlpAttribute struct {
+	key   string
+	value interface{}
+}
+
+// OTLPSink exports every message as an OpenTelemetry LogRecord to a collector
+// with OTLP over HTTP and protobuf.
+type OTLPSink struct {
+	*batcher
+	options OTLPOptions
+	client  *http.Client
+}
+
+func NewOTLPSink(options OTLPOptions) (*OTLPSink, error) {
+	if options.Endpoint == "" {
+		return nil, errors.New("the otlp sink needs an endpoint, ie: otlp:http://otel-collector:4318")
+	}
+
+	defaults := DefaultOTLPOptions()
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = defaults.FlushInterval
+	}
+	options.Endpoint = strings.TrimSuffix(options.Endpoint, "/")
+	if !strings.HasSuffix(options.Endpoint, "/v1/logs") {
+		options.Endpoint += "/v1/logs"
+	}
+
+	sink := &OTLPSink{
+		options: options,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	sink.batcher = newBatcher("otlp", batcherOptions{
+		BatchSize:     options.BatchSize,
+		FlushInterval: options.FlushInterval,
+		MaxRetries:    options.MaxRetries,
+		RetryBackoff:  options.RetryBackoff,
+	}, sink.export)
+	return sink, nil
+}
+
+// newOTLPRecord maps a message onto a LogRecord. The whole message is its body,
+// and its scalar fields are its attributes, under their semantic convention
+// names where there is one.
+func newOTLPRecord(event *Event) *otlpRecord {
+	record := &otlpRecord{
+		timestamp: event.CreatedAt(),
+		observed:  time.Now(),
+		body:      string(event.Payload),
+	}
+
+	fields := event.Fields()
+
+	record.hostName, _ = fields["hostname"].(string)
+	record.timberVersion, _ = fields["timber_version"].(string)
+	record.severity, _ = fields["severity"].(string)
+	if _, ok := fields["query"]; !ok {
+		// Errors carry the statement that failed instead of a query.
+		if statement, ok := fields["statement"]; ok {
+			fields["query"] = statement
+			delete(fields, "statement")
+		}
+	}
+
+	record.attributes = append(record.attributes, otlpAttribute{"db.system", "postgresql"})
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch key {
+		case "hostname", "timber_version", "created_at":
+			continue
+		}
+		name := key
+		if semantic, ok := otlpAttributeNames[key]; ok {
+			name = semantic
+		}
+		switch value := fields[key].(type) {
+		case string:
+			if value != "" {
+				record.attributes = append(record.attributes, otlpAttribute{name, value})
+			}
+		case bool:
+			record.attributes = append(record.attributes, otlpAttribute{name, value})
+		case float64:
+			// json can't tell 1.0 from 1, so numbers are all doubles to keep
+			// the type of an attribute the same from one record to the next.
+			record.attributes = append(record.attributes, otlpAttribute{name, value})
+		}
+	}
+	return record
+}
+
+func (self *OTLPSink) Write(ctx context.Context, event *Event) error {
+	record := newOTLPRecord(event)
+	return self.add(record, len(record.body))
+}
+
+// export sends a batch, and returns it when it is worth trying again because
+// the collector is unreachable or asks for a retry with the statuses below.
+func (self *OTLPSink) export(batch []interface{}) ([]interface{}, error) {
+	records := make([]*otlpRecord, len(batch))
+	for i, record := range batch {
+		records[i] = record.(*otlpRecord)
+	}
+
+	request, err := http.NewRequest("POST", self.options.Endpoint, bytes.NewReader(encodeOTLPLogs(records)))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	for key, value := range self.options.Headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		return batch, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 300 {
+		return nil, nil
+	}
+	b, _ := ioutil.ReadAll(response.Body)
+	err = fmt.Errorf("the otlp collector responded with %s: %s", response.Status, bytes.TrimSpace(b))
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return batch, err
+	}
+	return nil, err
+}
+
+// encodeOTLPLogs encodes an ExportLogsServiceRequest, with a ResourceLogs for
+// every host and timber version, from opentelemetry/proto/collector/logs/v1.
+func encodeOTLPLogs(records []*otlpRecord) []byte {
+	type resourceKey struct{ hostName, timberVersion string }
+	resources := make(map[resourceKey][]*otlpRecord)
+	keys := []resourceKey{}
+	for _, record := range records {
+		key := resourceKey{record.hostName, record.timberVersion}
+		if _, ok := resources[key]; !ok {
+			keys = append(keys, key)
+		}
+		resources[key] = append(resources[key], record)
+	}
+
+	request := new(protoBuffer)
+	for _, key := range keys {
+		request.message(1, func(resourceLogs *protoBuffer) {
+			resourceLogs.message(1, func(resource *protoBuffer) {
+				resource.keyValue(1, "service.name", "timber")
+				if key.hostName != "" {
+					resource.keyValue(1, "host.name", key.hostName)
+				}
+				if key.timberVersion != "" {
+					resource.keyValue(1, "timber_version", key.timberVersion)
+				}
+			})
+			resourceLogs.message(2, func(scopeLogs *protoBuffer) {
+				scopeLogs.message(1, func(scope *protoBuffer) {
+					scope.string(1, "timber")
+				})
+				for _, record := range resources[key] {
+					scopeLogs.message(2, record.encode)
+				}
+			})
+		})
+	}
+	return request.Bytes()
+}
+
+// encode writes the fields of a LogRecord.
+func (self *otlpRecord) encode(buffer *protoBuffer) {
+	buffer.fixed64(1, uint64(self.timestamp.UnixNano()))
+	severityNumber, ok := otlpSeverityNumbers[self.severity]
+	if !ok {
+		severityNumber = otlpSeverityInfo
+	}
+	buffer.varint(2, uint64(severityNumber))
+	if self.severity != "" {
+		buffer.string(3, self.severity)
+	}
+	buffer.message(5, func(body *protoBuffer) {
+		body.string(1, self.body)
+	})
+	for _, attribute := range self.attributes {
+		buffer.keyValue(6, attribute.key, attribute.value)
+	}
+	buffer.fixed64(11, uint64(self.observed.UnixNano()))
+}
+
+// protoBuffer writes the protobuf wire format, for the few messages timber
+// sends.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (self *protoBuffer) tag(field int, wireType int) {
+	self.rawVarint(uint64(field<<3 | wireType))
+}
+
+func (self *protoBuffer) rawVarint(value uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], value)
+	self.Write(b[:n])
+}
+
+func (self *protoBuffer) varint(field int, value uint64) {
+	self.tag(field, 0)
+	self.rawVarint(value)
+}
+
+func (self *protoBuffer) fixed64(field int, value uint64) {
+	self.tag(field, 1)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], value)
+	self.Write(b[:])
+}
+
+func (self *protoBuffer) bytes(field int, value []byte) {
+	self.tag(field, 2)
+	self.rawVarint(uint64(len(value)))
+	self.Write(value)
+}
+
+func (self *protoBuffer) string(field int, value string) {
+	self.bytes(field, []byte(value))
+}
+
+func (self *protoBuffer) message(field int, encode func(*protoBuffer)) {
+	inner := new(protoBuffer)
+	encode(inner)
+	self.bytes(field, inner.Bytes())
+}
+
+// keyValue writes a KeyValue with a string, bool or double AnyValue.
+func (self *protoBuffer) keyValue(field int, key string, value interface{}) {
+	self.message(field, func(keyValue *protoBuffer) {
+		keyValue.string(1, key)
+		keyValue.message(2, func(anyValue *protoBuffer) {
+			switch value := value.(type) {
+			case string:
+				anyValue.string(1, value)
+			case bool:
+				b := uint64(0)
+				if value {
+					b = 1
+				}
+				anyValue.varint(2, b)
+			case float64:
+				anyValue.fixed64(4, math.Float64bits(value))
+			}
+		})
+	})
+}
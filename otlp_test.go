@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// protoFields decodes a protobuf message into the values of each field:
+// uint64 for varint and fixed64 fields, []byte for the others.
+type protoFields map[int][]interface{}
+
+func decodeProto(t *testing.T, b []byte) protoFields {
+	fields := make(protoFields)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid protobuf tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+
+		switch tag & 7 {
+		case 0:
+			value, n := binary.Uvarint(b)
+			b = b[n:]
+			fields[field] = append(fields[field], value)
+		case 1:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			b = b[n:]
+			fields[field] = append(fields[field], b[:length])
+			b = b[length:]
+		default:
+			t.Fatalf("unexpected protobuf wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+func (self protoFields) messages(t *testing.T, field int) []protoFields {
+	messages := []protoFields{}
+	for _, value := range self[field] {
+		messages = append(messages, decodeProto(t, value.([]byte)))
+	}
+	return messages
+}
+
+func (self protoFields) string(field int) string {
+	if len(self[field]) == 0 {
+		return ""
+	}
+	return string(self[field][0].([]byte))
+}
+
+// attributes decodes the KeyValues of a field into their string, bool, int64
+// or float64 values.
+func (self protoFields) attributes(t *testing.T, field int) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	for _, keyValue := range self.messages(t, field) {
+		anyValue := keyValue.messages(t, 2)[0]
+		var value interface{}
+		switch {
+		case len(anyValue[1]) > 0:
+			value = anyValue.string(1)
+		case len(anyValue[2]) > 0:
+			value = anyValue[2][0].(uint64) == 1
+		case len(anyValue[3]) > 0:
+			value = int64(anyValue[3][0].(uint64))
+		case len(anyValue[4]) > 0:
+			value = math.Float64frombits(anyValue[4][0].(uint64))
+		}
+		attributes[keyValue.string(1)] = value
+	}
+	return attributes
+}
+
+// The answer to an export the collector took.
+var otlpExported = cannedResponse{status: http.StatusOK}
+
+func testOTLPOptions(endpoint string) OTLPOptions {
+	options := DefaultOTLPOptions()
+	options.Endpoint = endpoint
+	options.FlushInterval = time.Hour
+	options.RetryBackoff = time.Millisecond
+	return options
+}
+
+func TestOTLPSink_ExportsLogRecords(t *testing.T) {
+	receiver := newRecordingServer(otlpExported)
+	defer receiver.Close()
+
+	options := testOTLPOptions(receiver.URL)
+	options.Headers = map[string]string{"Api-Key": "secret"}
+	sink, err := NewOTLPSink(options)
+	assert.Nil(t, err)
+
+	slowQuery := &SlowQueryMessage{
+		Command:                "statement",
+		Query:                  "SELECT * FROM \"shard_1\".accounts",
+		Database:               "ledger",
+		Username:               "app",
+		ShardName:              "shard_1",
+		DurationInMilliseconds: 1.5,
+		CreatedAt:              "2021-02-19 15:04:05.123 +0000 UTC",
+		Type:                   "timber.postgres_slow_query",
+		HostName:               "db1",
+		TimberVersion:          "0.0.8",
+		SampleRate:             1,
+	}
+	postgresError := &PostgresErrorMessage{
+		Severity:  "FATAL",
+		Message:   "the database system is shutting down",
+		Statement: "SELECT 1",
+		Database:  "ledger",
+		Username:  "app",
+		CreatedAt: "2021-02-19 15:04:06 +0000 UTC",
+		Type:      "timber.postgres_error",
+		HostName:  "db2",
+	}
+	SendMessage(slowQuery, sink)
+	SendMessage(postgresError, sink)
+	assert.Nil(t, sink.Close())
+
+	requests, bodies := receiver.received()
+	assert.Len(t, requests, 1)
+	request := requests[0]
+	assert.Equal(t, "/v1/logs", request.URL.Path)
+	assert.Equal(t, "application/x-protobuf", request.Header.Get("Content-Type"))
+	assert.Equal(t, "secret", request.Header.Get("Api-Key"))
+
+	// A ResourceLogs for each host.
+	resourceLogs := decodeProto(t, bodies[0]).messages(t, 1)
+	assert.Len(t, resourceLogs, 2)
+	assert.Equal(t, map[string]interface{}{"service.name": "timber", "host.name": "db1", "timber_version": "0.0.8"},
+		resourceLogs[0].messages(t, 1)[0].attributes(t, 1))
+	assert.Equal(t, map[string]interface{}{"service.name": "timber", "host.name": "db2"},
+		resourceLogs[1].messages(t, 1)[0].attributes(t, 1))
+
+	scopeLogs := resourceLogs[0].messages(t, 2)[0]
+	assert.Equal(t, "timber", scopeLogs.messages(t, 1)[0].string(1))
+	records := scopeLogs.messages(t, 2)
+	assert.Len(t, records, 1)
+	record := records[0]
+	assert.Equal(t, uint64(time.Date(2021, 2, 19, 15, 4, 5, 123000000, time.UTC).UnixNano()), record[1][0])
+	assert.Equal(t, uint64(otlpSeverityInfo), record[2][0])
+	assert.Contains(t, record.messages(t, 5)[0].string(1), `"query":"SELECT * FROM \"shard_1\".accounts"`)
+	assert.NotEmpty(t, record[11])
+
+	attributes := record.attributes(t, 6)
+	assert.Equal(t, "postgresql", attributes["db.system"])
+	assert.Equal(t, "ledger", attributes["db.name"])
+	assert.Equal(t, "app", attributes["db.user"])
+	assert.Equal(t, "SELECT * FROM \"shard_1\".accounts", attributes["db.statement"])
+	assert.Equal(t, "shard_1", attributes["shard_name"])
+	assert.Equal(t, 1.5, attributes["duration_in_milliseconds"])
+	assert.Equal(t, 1.0, attributes["sample_rate"])
+	assert.Equal(t, "timber.postgres_slow_query", attributes["type"])
+	assert.NotContains(t, attributes, "hostname")
+	assert.NotContains(t, attributes, "query")
+
+	// Errors have their severity, and the statement that failed.
+	record = resourceLogs[1].messages(t, 2)[0].messages(t, 2)[0]
+	assert.Equal(t, uint64(21), record[2][0])
+	assert.Equal(t, "FATAL", record.string(3))
+	attributes = record.attributes(t, 6)
+	assert.Equal(t, "SELECT 1", attributes["db.statement"])
+	assert.NotContains(t, attributes, "statement")
+}
+
+func TestOTLPSink_RetriesWhenAsked(t *testing.T) {
+	receiver := newRecordingServer(otlpExported, cannedResponse{status: http.StatusServiceUnavailable}, cannedResponse{status: http.StatusTooManyRequests})
+	defer receiver.Close()
+
+	sink, err := NewOTLPSink(testOTLPOptions(receiver.URL + "/v1/logs"))
+	assert.Nil(t, err)
+
+	SendMessage(map[string]string{"type": "timber.postgres_checkpoint"}, sink)
+	assert.Nil(t, sink.Flush())
+	requests, _ := receiver.received()
+	assert.Len(t, requests, 3)
+	assert.Equal(t, "/v1/logs", requests[2].URL.Path)
+	assert.Nil(t, sink.Close())
+}
+
+func TestOTLPSink_DropsRefusedExports(t *testing.T) {
+	receiver := newRecordingServer(otlpExported, cannedResponse{status: http.StatusBadRequest})
+	defer receiver.Close()
+
+	sink, err := NewOTLPSink(testOTLPOptions(receiver.URL))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Write(context.Background(), testEvent(t, "SELECT 1")))
+	assert.NotNil(t, sink.Flush())
+	assert.Nil(t, sink.Close())
+	requests, _ := receiver.received()
+	assert.Len(t, requests, 1)
+}
+
+func TestHeaderFlag(t *testing.T) {
+	headers := headerFlag{}
+	assert.Nil(t, headers.Set("Authorization=Bearer a=b"))
+	assert.Nil(t, headers.Set("X-Tenant=dba"))
+	assert.NotNil(t, headers.Set("no-value"))
+	assert.Equal(t, "Authorization=Bearer a=b,X-Tenant=dba", headers.String())
+}
@@ -0,0 +1,55 @@
+package main
+
+// IsErrorSeverity reports whether the severity is one that aborts a statement,
+// a session or the whole server.
+func IsErrorSeverity(severity string) bool {
+	switch severity {
+	case "ERROR", "FATAL", "PANIC":
+		return true
+	}
+	return false
+}
+
+type PostgresErrorMessage struct {
+	Severity           string `json:"severity"`
+	SQLState           string `json:"sql_state,omitempty"`
+	Message            string `json:"message"`
+	Statement          string `json:"statement,omitempty"`
+	Database           string `json:"database"`
+	Username           string `json:"username"`
+	ApplicationName    string `json:"application_name,omitempty"`
+	ShardName          string `json:"shard_name"`
+	ShardlessStatement string `json:"shardless_statement,omitempty"`
+	CreatedAt          string `json:"created_at"`
+	Type               string `json:"type"`
+	HostName           string `json:"hostname"`
+	TimberVersion      string `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// LogPostgresError sends an ERROR, FATAL or PANIC entry along with the scrubbed
+// statement that triggered it. The SQLSTATE is only known when the
+// log_line_prefix contains %e or the log is a csvlog or jsonlog.
+func LogPostgresError(logLine *PostgresLogLine, sink Sink) {
+	shardName, shardlessStatement := DerivedValues(logLine.Statement)
+
+	msg := &PostgresErrorMessage{
+		Severity:           logLine.Severity,
+		SQLState:           logLine.SQLState,
+		Message:            logLine.Message,
+		Statement:          ScrubQuery(logLine.Statement),
+		Database:           logLine.Database,
+		Username:           logLine.Username,
+		ApplicationName:    logLine.ApplicationName,
+		ShardName:          shardName,
+		ShardlessStatement: ScrubQuery(shardlessStatement),
+		CreatedAt:          logLine.CreatedAt(),
+		Type:               "timber.postgres_error",
+		HostName:           logLine.HostName(),
+		TimberVersion:      TimberVersion(),
+		SourceMetadata:     logLine.Source,
+	}
+
+	SendMessage(msg, sink)
+}
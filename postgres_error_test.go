@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingErrorWithStatement(t *testing.T) {
+	log := `2021-03-13 11:45:00.123 UTC [4242-7] 23505 app@ledger ERROR:  duplicate key value violates unique constraint "users_pkey"
+2021-03-13 11:45:00.123 UTC [4242-8] 23505 app@ledger DETAIL:  Key (id)=(1) already exists.
+2021-03-13 11:45:00.123 UTC [4242-9] 23505 app@ledger STATEMENT:  INSERT INTO abacus3_qa.users (id, name) VALUES (1, 'bob')
+2021-03-13 11:45:01.000 UTC [4243-1] 00000 @ LOG:  checkpoint starting: time
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParserWithPrefix(scanner, MustLogLinePrefix("%m [%p-%l] %e %q%u@%d "))
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR", pgLog.Severity)
+	assert.Equal(t, "23505", pgLog.SQLState)
+	assert.Equal(t, `duplicate key value violates unique constraint "users_pkey"`, pgLog.Message)
+	assert.Equal(t, "Key (id)=(1) already exists.", pgLog.Detail)
+	assert.Equal(t, "INSERT INTO abacus3_qa.users (id, name) VALUES (1, 'bob')", pgLog.Statement)
+
+	// Other entries without a duration are still skipped.
+	_, err = logParser.Parse()
+	assert.Equal(t, ErrInvalidLogLine, err)
+}
+
+func TestLogPostgresError(t *testing.T) {
+	logLine := &PostgresLogLine{
+		Severity:  "ERROR",
+		SQLState:  "40001",
+		Username:  "app",
+		Database:  "ledger",
+		Message:   "could not serialize access due to concurrent update",
+		Statement: `SELECT * FROM "abacus3_qa"."accounts" WHERE guid = 'ACT-123' FOR UPDATE`,
+	}
+
+	buffer := new(bytes.Buffer)
+	HandlePostgresLogLine(logLine, NewWriterSink(buffer))
+
+	msg := new(PostgresErrorMessage)
+	err := json.Unmarshal(buffer.Bytes(), msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "timber.postgres_error", msg.Type)
+	assert.Equal(t, "ERROR", msg.Severity)
+	assert.Equal(t, "40001", msg.SQLState)
+	assert.Equal(t, "could not serialize access due to concurrent update", msg.Message)
+	assert.Equal(t, `SELECT * FROM "abacus3_qa"."accounts" WHERE guid = 'xxx' FOR UPDATE`, msg.Statement)
+	assert.Equal(t, `SELECT * FROM "accounts" WHERE guid = 'xxx' FOR UPDATE`, msg.ShardlessStatement)
+	assert.Equal(t, "abacus3_qa", msg.ShardName)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidQueryPlan = errors.New("The parser could not derive a query plan from the auto_explain output")
+)
+
+// A scan that reads at least this many rows is flagged as a large sequential scan.
+const largeSeqScanRows = 10000
+
+// An estimate that is off from the actual rows by this factor is flagged as bad.
+const badRowEstimateFactor = 10
+
+// PlanNode is a single node of an auto_explain plan tree. Actual values are only
+// set when auto_explain.log_analyze is on and buffers only when
+// auto_explain.log_buffers is on.
+type PlanNode struct {
+	NodeType            string      `json:"node_type"`
+	RelationName        string      `json:"relation_name,omitempty"`
+	Schema              string      `json:"schema,omitempty"`
+	Alias               string      `json:"alias,omitempty"`
+	IndexName           string      `json:"index_name,omitempty"`
+	StartupCost         float64     `json:"startup_cost"`
+	TotalCost           float64     `json:"total_cost"`
+	PlanRows            float64     `json:"plan_rows"`
+	PlanWidth           int         `json:"plan_width"`
+	ActualStartupTime   float64     `json:"actual_startup_time_in_milliseconds"`
+	ActualTotalTime     float64     `json:"actual_total_time_in_milliseconds"`
+	ActualRows          float64     `json:"actual_rows"`
+	ActualLoops         float64     `json:"actual_loops"`
+	RowsRemovedByFilter float64     `json:"rows_removed_by_filter,omitempty"`
+	SharedHitBlocks     int64       `json:"shared_hit_blocks"`
+	SharedReadBlocks    int64       `json:"shared_read_blocks"`
+	SharedDirtiedBlocks int64       `json:"shared_dirtied_blocks"`
+	SharedWrittenBlocks int64       `json:"shared_written_blocks"`
+	TempReadBlocks      int64       `json:"temp_read_blocks"`
+	TempWrittenBlocks   int64       `json:"temp_written_blocks"`
+	SortMethod          string      `json:"sort_method,omitempty"`
+	SortSpaceUsed       int64       `json:"sort_space_used_in_kilobytes,omitempty"`
+	SortSpaceType       string      `json:"sort_space_type,omitempty"`
+	Plans               []*PlanNode `json:"plans,omitempty"`
+}
+
+// QueryPlan is a parsed auto_explain entry.
+type QueryPlan struct {
+	QueryText string
+	Format    string
+	Plan      *PlanNode
+}
+
+// ParseQueryPlan parses the text or json output of auto_explain.
+func ParseQueryPlan(value string) (*QueryPlan, error) {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		return parseJSONQueryPlan(trimmed)
+	}
+	return parseTextQueryPlan(value)
+}
+
+// jsonPlanNode is a plan node as written by auto_explain.log_format = json.
+type jsonPlanNode struct {
+	NodeType            string          `json:"Node Type"`
+	RelationName        string          `json:"Relation Name"`
+	Schema              string          `json:"Schema"`
+	Alias               string          `json:"Alias"`
+	IndexName           string          `json:"Index Name"`
+	StartupCost         float64         `json:"Startup Cost"`
+	TotalCost           float64         `json:"Total Cost"`
+	PlanRows            float64         `json:"Plan Rows"`
+	PlanWidth           int             `json:"Plan Width"`
+	ActualStartupTime   float64         `json:"Actual Startup Time"`
+	ActualTotalTime     float64         `json:"Actual Total Time"`
+	ActualRows          float64         `json:"Actual Rows"`
+	ActualLoops         float64         `json:"Actual Loops"`
+	RowsRemovedByFilter float64         `json:"Rows Removed by Filter"`
+	SharedHitBlocks     int64           `json:"Shared Hit Blocks"`
+	SharedReadBlocks    int64           `json:"Shared Read Blocks"`
+	SharedDirtiedBlocks int64           `json:"Shared Dirtied Blocks"`
+	SharedWrittenBlocks int64           `json:"Shared Written Blocks"`
+	TempReadBlocks      int64           `json:"Temp Read Blocks"`
+	TempWrittenBlocks   int64           `json:"Temp Written Blocks"`
+	SortMethod          string          `json:"Sort Method"`
+	SortSpaceUsed       int64           `json:"Sort Space Used"`
+	SortSpaceType       string          `json:"Sort Space Type"`
+	Plans               []*jsonPlanNode `json:"Plans"`
+}
+
+type jsonQueryPlan struct {
+	QueryText string        `json:"Query Text"`
+	Plan      *jsonPlanNode `json:"Plan"`
+}
+
+func parseJSONQueryPlan(value string) (*QueryPlan, error) {
+	plan := new(jsonQueryPlan)
+
+	// EXPLAIN (FORMAT JSON) wraps the plan in an array, auto_explain does not.
+	if strings.HasPrefix(value, "[") {
+		plans := []*jsonQueryPlan{}
+		err := json.Unmarshal([]byte(value), &plans)
+		if err != nil {
+			return nil, err
+		}
+		if len(plans) == 0 {
+			return nil, ErrInvalidQueryPlan
+		}
+		plan = plans[0]
+	} else {
+		err := json.Unmarshal([]byte(value), plan)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if plan.Plan == nil {
+		return nil, ErrInvalidQueryPlan
+	}
+
+	return &QueryPlan{
+		QueryText: plan.QueryText,
+		Format:    "json",
+		Plan:      plan.Plan.planNode(),
+	}, nil
+}
+
+func (self *jsonPlanNode) planNode() *PlanNode {
+	node := &PlanNode{
+		NodeType:            self.NodeType,
+		RelationName:        self.RelationName,
+		Schema:              self.Schema,
+		Alias:               self.Alias,
+		IndexName:           self.IndexName,
+		StartupCost:         self.StartupCost,
+		TotalCost:           self.TotalCost,
+		PlanRows:            self.PlanRows,
+		PlanWidth:           self.PlanWidth,
+		ActualStartupTime:   self.ActualStartupTime,
+		ActualTotalTime:     self.ActualTotalTime,
+		ActualRows:          self.ActualRows,
+		ActualLoops:         self.ActualLoops,
+		RowsRemovedByFilter: self.RowsRemovedByFilter,
+		SharedHitBlocks:     self.SharedHitBlocks,
+		SharedReadBlocks:    self.SharedReadBlocks,
+		SharedDirtiedBlocks: self.SharedDirtiedBlocks,
+		SharedWrittenBlocks: self.SharedWrittenBlocks,
+		TempReadBlocks:      self.TempReadBlocks,
+		TempWrittenBlocks:   self.TempWrittenBlocks,
+		SortMethod:          self.SortMethod,
+		SortSpaceUsed:       self.SortSpaceUsed,
+		SortSpaceType:       self.SortSpaceType,
+	}
+	for _, child := range self.Plans {
+		node.Plans = append(node.Plans, child.planNode())
+	}
+	return node
+}
+
+var (
+	// ie: "->  Seq Scan on users u  (cost=0.00..35.50 rows=2550 width=4) (actual time=0.010..0.011 rows=1 loops=1)"
+	RegexPlanNodeHeader = regexp.MustCompile(`^(\s*)(?:->\s+)?(.+?)` +
+		`(?:\s+\(cost=([\d.]+)\.\.([\d.]+) rows=([\d.]+) width=(\d+)\))?` +
+		`(?:\s+\((?:actual (?:time=([\d.]+)\.\.([\d.]+) )?rows=([\d.]+) loops=([\d.]+)|(never executed))\))?\s*$`)
+	RegexPlanSortMethod = regexp.MustCompile(`^Sort Method: (.+?)\s+(Memory|Disk): (\d+)kB`)
+	RegexPlanBuffers    = regexp.MustCompile(`(shared|temp|local)((?: (?:hit|read|dirtied|written)=\d+)+)`)
+)
+
+func parseTextQueryPlan(value string) (*QueryPlan, error) {
+	plan := &QueryPlan{Format: "text"}
+	queryText := []string{}
+	inQueryText := false
+
+	type stackEntry struct {
+		indent int
+		node   *PlanNode
+	}
+	stack := []stackEntry{}
+
+	for _, line := range strings.Split(strings.Replace(value, "\r\n", "\n", -1), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if plan.Plan == nil && strings.HasPrefix(trimmed, "Query Text: ") {
+			queryText = append(queryText, strings.TrimPrefix(trimmed, "Query Text: "))
+			inQueryText = true
+			continue
+		}
+
+		indent, node := parsePlanNodeHeader(line)
+		if node == nil {
+			if inQueryText {
+				queryText = append(queryText, trimmed)
+			} else if len(stack) > 0 {
+				parsePlanNodeAttribute(trimmed, stack[len(stack)-1].node)
+			}
+			continue
+		}
+		inQueryText = false
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			if plan.Plan != nil {
+				// A second root would mean this is not a single plan.
+				break
+			}
+			plan.Plan = node
+		} else {
+			parent := stack[len(stack)-1].node
+			parent.Plans = append(parent.Plans, node)
+		}
+		stack = append(stack, stackEntry{indent: indent, node: node})
+	}
+
+	if plan.Plan == nil {
+		return nil, ErrInvalidQueryPlan
+	}
+	plan.QueryText = strings.Join(queryText, "\n")
+	return plan, nil
+}
+
+func parsePlanNodeHeader(line string) (int, *PlanNode) {
+	match := RegexPlanNodeHeader.FindStringSubmatch(line)
+	if match == nil || (match[3] == "" && match[9] == "" && match[11] == "") {
+		return 0, nil
+	}
+
+	node := new(PlanNode)
+	node.StartupCost, _ = strconv.ParseFloat(match[3], 64)
+	node.TotalCost, _ = strconv.ParseFloat(match[4], 64)
+	node.PlanRows, _ = strconv.ParseFloat(match[5], 64)
+	node.PlanWidth, _ = strconv.Atoi(match[6])
+	node.ActualStartupTime, _ = strconv.ParseFloat(match[7], 64)
+	node.ActualTotalTime, _ = strconv.ParseFloat(match[8], 64)
+	node.ActualRows, _ = strconv.ParseFloat(match[9], 64)
+	node.ActualLoops, _ = strconv.ParseFloat(match[10], 64)
+
+	// ie: "Index Scan using users_pkey on public.users u"
+	name := match[2]
+	target := ""
+	if index := strings.Index(name, " on "); index >= 0 {
+		target = name[index+len(" on "):]
+		name = name[:index]
+	}
+	if index := strings.Index(name, " using "); index >= 0 {
+		node.IndexName = name[index+len(" using "):]
+		name = name[:index]
+	}
+	node.NodeType = strings.TrimSuffix(name, " Backward")
+
+	if target != "" {
+		if node.NodeType == "Bitmap Index Scan" {
+			node.IndexName = target
+		} else {
+			parts := strings.Fields(target)
+			node.RelationName = parts[0]
+			if dot := strings.LastIndex(node.RelationName, "."); dot >= 0 {
+				node.Schema = node.RelationName[:dot]
+				node.RelationName = node.RelationName[dot+1:]
+			}
+			if len(parts) > 1 {
+				node.Alias = parts[1]
+			}
+		}
+	}
+
+	indent := len(match[1])
+	return indent, node
+}
+
+func parsePlanNodeAttribute(attribute string, node *PlanNode) {
+	switch {
+	case strings.HasPrefix(attribute, "Rows Removed by Filter: "):
+		node.RowsRemovedByFilter, _ = strconv.ParseFloat(strings.TrimPrefix(attribute, "Rows Removed by Filter: "), 64)
+	case strings.HasPrefix(attribute, "Sort Method: "):
+		match := RegexPlanSortMethod.FindStringSubmatch(attribute)
+		if match == nil {
+			node.SortMethod = strings.TrimPrefix(attribute, "Sort Method: ")
+			return
+		}
+		node.SortMethod = match[1]
+		node.SortSpaceType = match[2]
+		node.SortSpaceUsed, _ = strconv.ParseInt(match[3], 10, 64)
+	case strings.HasPrefix(attribute, "Buffers: "):
+		for _, match := range RegexPlanBuffers.FindAllStringSubmatch(attribute, -1) {
+			for _, field := range strings.Fields(match[2]) {
+				keyValue := strings.SplitN(field, "=", 2)
+				blocks, _ := strconv.ParseInt(keyValue[1], 10, 64)
+				switch match[1] + " " + keyValue[0] {
+				case "shared hit":
+					node.SharedHitBlocks = blocks
+				case "shared read":
+					node.SharedReadBlocks = blocks
+				case "shared dirtied":
+					node.SharedDirtiedBlocks = blocks
+				case "shared written":
+					node.SharedWrittenBlocks = blocks
+				case "temp read":
+					node.TempReadBlocks = blocks
+				case "temp written":
+					node.TempWrittenBlocks = blocks
+				}
+			}
+		}
+	}
+}
+
+// Walk calls fn for the node and every node below it.
+func (self *PlanNode) Walk(fn func(node *PlanNode)) {
+	fn(self)
+	for _, child := range self.Plans {
+		child.Walk(fn)
+	}
+}
+
+func (self *PlanNode) analyzed() bool {
+	return self.ActualLoops > 0
+}
+
+// IsLargeSeqScan reports whether the node is a sequential scan that read, or was
+// estimated to read, at least largeSeqScanRows rows.
+func (self *PlanNode) IsLargeSeqScan() bool {
+	if !strings.HasSuffix(self.NodeType, "Seq Scan") {
+		return false
+	}
+	rows := self.PlanRows
+	if self.analyzed() {
+		rows = (self.ActualRows + self.RowsRemovedByFilter) * self.ActualLoops
+	}
+	return rows >= largeSeqScanRows
+}
+
+// HasBadRowEstimate reports whether the planner's row estimate was off from the
+// actual rows by at least badRowEstimateFactor.
+func (self *PlanNode) HasBadRowEstimate() bool {
+	if !self.analyzed() {
+		return false
+	}
+	low, high := self.PlanRows, self.ActualRows
+	if low > high {
+		low, high = high, low
+	}
+	return (high+1)/(low+1) >= badRowEstimateFactor
+}
+
+// IsDiskSort reports whether the node sorted on disk instead of in memory.
+func (self *PlanNode) IsDiskSort() bool {
+	return self.SortSpaceType == "Disk" || strings.HasPrefix(self.SortMethod, "external")
+}
+
+type QueryPlanMessage struct {
+	Query                  string    `json:"query"`
+	QueryID                string    `json:"query_id,omitempty"`
+	Database               string    `json:"database"`
+	Username               string    `json:"username"`
+	ShardName              string    `json:"shard_name"`
+	ShardlessQuery         string    `json:"shardless_query"`
+	DurationInMilliseconds float64   `json:"duration_in_milliseconds"`
+	PlanFormat             string    `json:"plan_format"`
+	Plan                   *PlanNode `json:"plan"`
+	SeqScanOnLargeRelation bool      `json:"seq_scan_on_large_relation"`
+	BadRowEstimate         bool      `json:"bad_row_estimate"`
+	SortSpilledToDisk      bool      `json:"sort_spilled_to_disk"`
+	CreatedAt              string    `json:"created_at"`
+	Type                   string    `json:"type"`
+	HostName               string    `json:"hostname"`
+	TimberVersion          string    `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+func LogQueryPlan(logLine *PostgresLogLine, sink Sink) {
+	plan, err := ParseQueryPlan(logLine.Value)
+	if err != nil {
+		fmt.Println("Could not parse the query plan:", err)
+		return
+	}
+
+	shardName, shardlessQuery := DerivedValues(plan.QueryText)
+
+	msg := &QueryPlanMessage{
+		Query:                  ScrubQuery(plan.QueryText),
+		QueryID:                logLine.QueryID,
+		Database:               logLine.Database,
+		Username:               logLine.Username,
+		ShardName:              shardName,
+		ShardlessQuery:         ScrubQuery(shardlessQuery),
+		DurationInMilliseconds: float64(logLine.Duration.Microseconds()) / 1000.0,
+		PlanFormat:             plan.Format,
+		Plan:                   plan.Plan,
+		CreatedAt:              logLine.CreatedAt(),
+		Type:                   "timber.postgres_query_plan",
+		HostName:               logLine.HostName(),
+		TimberVersion:          TimberVersion(),
+		SourceMetadata:         logLine.Source,
+	}
+
+	plan.Plan.Walk(func(node *PlanNode) {
+		msg.SeqScanOnLargeRelation = msg.SeqScanOnLargeRelation || node.IsLargeSeqScan()
+		msg.BadRowEstimate = msg.BadRowEstimate || node.HasBadRowEstimate()
+		msg.SortSpilledToDisk = msg.SortSpilledToDisk || node.IsDiskSort()
+	})
+
+	SendMessage(msg, sink)
+}
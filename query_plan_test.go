@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingTextQueryPlan(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [56193-3/9939-5706] postgres@walle_test LOG:  duration: 1203.401 ms  plan:
+	Query Text: SELECT * FROM abacus3_qa.transactions t
+	  WHERE t.description = 'coffee' ORDER BY t.amount
+	Sort  (cost=20000.00..20100.00 rows=10 width=64) (actual time=1100.000..1200.000 rows=45000 loops=1)
+	  Sort Key: amount
+	  Sort Method: external merge  Disk: 4096kB
+	  Buffers: shared hit=12 read=3400, temp read=512 written=513
+	  ->  Seq Scan on abacus3_qa.transactions t  (cost=0.00..18000.00 rows=10 width=64) (actual time=0.010..900.000 rows=45000 loops=1)
+	        Filter: (description = 'coffee'::text)
+	        Rows Removed by Filter: 955000
+	        Buffers: shared hit=12 read=3400
+	  ->  Index Scan using users_pkey on users  (cost=0.29..8.30 rows=1 width=4) (never executed)
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "plan", pgLog.LogType)
+
+	plan, err := ParseQueryPlan(pgLog.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "text", plan.Format)
+	assert.Equal(t, "SELECT * FROM abacus3_qa.transactions t\nWHERE t.description = 'coffee' ORDER BY t.amount", plan.QueryText)
+
+	sort := plan.Plan
+	assert.Equal(t, "Sort", sort.NodeType)
+	assert.Equal(t, float64(10), sort.PlanRows)
+	assert.Equal(t, float64(45000), sort.ActualRows)
+	assert.Equal(t, "external merge", sort.SortMethod)
+	assert.Equal(t, "Disk", sort.SortSpaceType)
+	assert.Equal(t, int64(4096), sort.SortSpaceUsed)
+	assert.Equal(t, int64(3400), sort.SharedReadBlocks)
+	assert.Equal(t, int64(513), sort.TempWrittenBlocks)
+	assert.True(t, sort.IsDiskSort())
+	assert.True(t, sort.HasBadRowEstimate())
+	assert.Len(t, sort.Plans, 2)
+
+	scan := sort.Plans[0]
+	assert.Equal(t, "Seq Scan", scan.NodeType)
+	assert.Equal(t, "abacus3_qa", scan.Schema)
+	assert.Equal(t, "transactions", scan.RelationName)
+	assert.Equal(t, "t", scan.Alias)
+	assert.Equal(t, float64(955000), scan.RowsRemovedByFilter)
+	assert.Equal(t, 900.0, scan.ActualTotalTime)
+	assert.True(t, scan.IsLargeSeqScan())
+
+	index := sort.Plans[1]
+	assert.Equal(t, "Index Scan", index.NodeType)
+	assert.Equal(t, "users_pkey", index.IndexName)
+	assert.Equal(t, "users", index.RelationName)
+	assert.False(t, index.HasBadRowEstimate())
+}
+
+func TestParsingJSONQueryPlan(t *testing.T) {
+	value := `{
+	  "Query Text": "SELECT * FROM users WHERE id = 1",
+	  "Plan": {
+	    "Node Type": "Limit",
+	    "Startup Cost": 0.29,
+	    "Total Cost": 8.30,
+	    "Plan Rows": 1,
+	    "Plan Width": 4,
+	    "Actual Rows": 1,
+	    "Actual Loops": 1,
+	    "Plans": [
+	      {
+	        "Node Type": "Index Scan",
+	        "Index Name": "users_pkey",
+	        "Relation Name": "users",
+	        "Schema": "public",
+	        "Plan Rows": 1,
+	        "Actual Rows": 1,
+	        "Actual Loops": 1,
+	        "Shared Hit Blocks": 4
+	      }
+	    ]
+	  }
+	}`
+
+	plan, err := ParseQueryPlan(value)
+	assert.Nil(t, err)
+	assert.Equal(t, "json", plan.Format)
+	assert.Equal(t, "SELECT * FROM users WHERE id = 1", plan.QueryText)
+	assert.Equal(t, "Limit", plan.Plan.NodeType)
+	assert.Equal(t, "Index Scan", plan.Plan.Plans[0].NodeType)
+	assert.Equal(t, "public", plan.Plan.Plans[0].Schema)
+	assert.Equal(t, int64(4), plan.Plan.Plans[0].SharedHitBlocks)
+
+	_, err = ParseQueryPlan(`{"Query Text": "SELECT 1"}`)
+	assert.Equal(t, ErrInvalidQueryPlan, err)
+
+	_, err = ParseQueryPlan("Query Text: SELECT 1")
+	assert.Equal(t, ErrInvalidQueryPlan, err)
+}
+
+func TestLogQueryPlan(t *testing.T) {
+	logLine := &PostgresLogLine{
+		Username: "postgres",
+		Database: "walle_test",
+		LogType:  "plan",
+		Value: `Query Text: SELECT * FROM abacus3_qa.transactions WHERE amount = '7.82'
+Seq Scan on transactions  (cost=0.00..18000.00 rows=50000 width=64)
+  Filter: (amount = '7.82'::numeric)`,
+	}
+
+	buffer := new(bytes.Buffer)
+	LogQueryPlan(logLine, NewWriterSink(buffer))
+
+	msg := new(QueryPlanMessage)
+	err := json.Unmarshal(buffer.Bytes(), msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "timber.postgres_query_plan", msg.Type)
+	assert.Equal(t, `SELECT * FROM abacus3_qa.transactions WHERE amount = 'xxx'`, msg.Query)
+	assert.Equal(t, `SELECT * FROM transactions WHERE amount = 'xxx'`, msg.ShardlessQuery)
+	assert.Equal(t, "abacus3_qa", msg.ShardName)
+	assert.Equal(t, "Seq Scan", msg.Plan.NodeType)
+	assert.True(t, msg.SeqScanOnLargeRelation)
+	assert.False(t, msg.BadRowEstimate)
+	assert.False(t, msg.SortSpilledToDisk)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ReplaySummary counts what happened to the entries of the replayed files.
+type ReplaySummary struct {
+	Files   int
+	Parsed  int
+	Skipped int
+	Errored int
+}
+
+func (self ReplaySummary) String() string {
+	return fmt.Sprintf("%d file(s), %d entries parsed, %d skipped, %d errored", self.Files, self.Parsed, self.Skipped, self.Errored)
+}
+
+// Replayer sends the entries of old log files at full speed, dated by the
+// entries themselves.
+type Replayer struct {
+	InputFormat      string
+	Prefix           *LogLinePrefix
+	ProgressInterval time.Duration
+	// Where progress is reported, ie: os.Stderr.
+	Progress io.Writer
+
+	Summary ReplaySummary
+}
+
+// ReplayFile sends a message for every entry of a plain, compressed or tar file
+// to sink.
+func (self *Replayer) ReplayFile(path string, sink Sink) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	counter := &countingReader{reader: file}
+	reader, err := NewLogReader(counter)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	parser, err := self.parser(reader)
+	if err != nil {
+		return err
+	}
+
+	self.Summary.Files++
+	reportedAt := time.Now()
+	for {
+		pgLogLine, err := parser.Parse()
+		if err == ErrLogEOF {
+			break
+		}
+		switch {
+		case err == ErrInvalidLogLine:
+			self.Summary.Skipped++
+		case err != nil:
+			self.Summary.Errored++
+		default:
+			self.Summary.Parsed++
+			HandlePostgresLogLine(pgLogLine, sink)
+		}
+
+		if self.ProgressInterval > 0 && time.Since(reportedAt) >= self.ProgressInterval {
+			reportedAt = time.Now()
+			self.reportProgress(path, counter.Count(), info.Size())
+		}
+	}
+
+	self.reportProgress(path, counter.Count(), info.Size())
+	return nil
+}
+
+func (self *Replayer) parser(reader io.Reader) (LogParser, error) {
+	if self.InputFormat == "csv" {
+		return NewCSVLogParser(reader), nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxBufferLength)
+
+	switch self.InputFormat {
+	case "stderr":
+		parser := NewPostgresLogParserWithPrefix(scanner, self.Prefix)
+		parser.idleTimeout = 0
+		return parser, nil
+	case "json":
+		return NewJSONLogParser(scanner), nil
+	}
+	return nil, fmt.Errorf("unknown input format: %s", self.InputFormat)
+}
+
+func (self *Replayer) reportProgress(path string, read int64, size int64) {
+	if self.Progress == nil {
+		return
+	}
+
+	percent := 100.0
+	if size > 0 {
+		percent = float64(read) * 100 / float64(size)
+	}
+	fmt.Fprintf(self.Progress, "%s: %.0f%% read, %s\n", path, percent, self.Summary)
+}
+
+// countingReader counts the bytes read from the file, before decompression,
+// so progress can be compared with the size of the file.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (self *countingReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	atomic.AddInt64(&self.count, int64(n))
+	return n, err
+}
+
+func (self *countingReader) Count() int64 {
+	return atomic.LoadInt64(&self.count)
+}
+
+// replayMain runs `timber replay [flags] file...`.
+func replayMain(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of ./timber replay [flags] file...:")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&inputFormat, "input-format", "stderr", "supports stderr for the plain postgres log, csv for csvlog and json for jsonlog")
+	flags.StringVar(&logLinePrefix, "log-line-prefix", DefaultLogLinePrefix, "the log_line_prefix from postgresql.conf used to parse log lines")
+	timezone := flags.String("log-timezone", "", "the log_timezone from postgresql.conf, ie: America/New_York, used to read the zone of log timestamps (default the local time zone)")
+	flags.StringVar(&tcpOutUrl, "tcp-out-url", "", "if set, will set up a log sink to given tcp destination")
+	addSinkFlags(flags)
+	flags.IntVar(&durationSampling.MinDurationStatement, "log-min-duration-statement", -1, "the log_min_duration_statement from postgresql.conf in milliseconds, used to derive the sample rate")
+	flags.IntVar(&durationSampling.MinDurationSample, "log-min-duration-sample", -1, "the log_min_duration_sample from postgresql.conf in milliseconds, used to derive the sample rate")
+	flags.Float64Var(&durationSampling.StatementSampleRate, "log-statement-sample-rate", 1.0, "the log_statement_sample_rate from postgresql.conf")
+	progressInterval := flags.Duration("progress-interval", 10*time.Second, "how often to report progress, 0 to only report at the end of each file")
+	flags.Parse(args)
+
+	hostname, _ = os.Hostname()
+	createdAtFromEntry = true
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+
+	prefix, err := NewLogLinePrefix(logLinePrefix)
+	if err != nil {
+		fmt.Println("Invalid log line prefix:", err)
+		return
+	}
+
+	if *timezone != "" {
+		logTimezone, err = time.LoadLocation(*timezone)
+		if err != nil {
+			fmt.Println("Invalid log timezone:", err)
+			return
+		}
+	}
+
+	// Replaying reads faster than we can send, so wait instead of dropping.
+	tcpSinkBlocking = true
+	batchedSinkBlocking = true
+	output, err := OpenSinks(sinkSpecs, tcpOutUrl)
+	if err != nil {
+		fmt.Println("Could not open the sinks:", err)
+		return
+	}
+	defer output.Close()
+
+	replayer := &Replayer{
+		InputFormat:      inputFormat,
+		Prefix:           prefix,
+		ProgressInterval: *progressInterval,
+		Progress:         os.Stderr,
+	}
+	for _, path := range flags.Args() {
+		err := replayer.ReplayFile(path, output)
+		if err != nil {
+			log.Println("Could not replay", path+":", err)
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Replayed", replayer.Summary)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const replayLog = `2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 1
+2021-02-19 15:04:06 UTC [56193-3/9939-5707] app@ledger LOG:  some entry timber has no use for
+2021-02-19 15:04:07 UTC [56193-3/9939-5708] app@ledger LOG:  duration: 2.000 ms  statement: SELECT *
+	FROM accounts
+`
+
+func replayToBuffer(t *testing.T, path string) (*Replayer, []string) {
+	createdAtFromEntry = true
+	defer func() { createdAtFromEntry = false }()
+
+	progress := new(bytes.Buffer)
+	replayer := &Replayer{
+		InputFormat: "stderr",
+		Prefix:      MustLogLinePrefix(DefaultLogLinePrefix),
+		Progress:    progress,
+	}
+	output := new(lockedBuffer)
+	assert.Nil(t, replayer.ReplayFile(path, NewWriterSink(output)))
+	assert.Contains(t, progress.String(), path+": 100% read")
+
+	return replayer, strings.Split(strings.TrimSpace(output.buffer.String()), "\n")
+}
+
+func TestReplayer_PlainFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "postgresql.log")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(replayLog), 0644))
+
+	replayer, messages := replayToBuffer(t, path)
+	assert.Equal(t, ReplaySummary{Files: 1, Parsed: 2, Skipped: 1}, replayer.Summary)
+	assert.Len(t, messages, 2)
+
+	// Messages are dated by their entries.
+	assert.Contains(t, messages[0], `"query":"SELECT 1"`)
+	assert.Contains(t, messages[0], `"created_at":"2021-02-19 15:04:05 +0000 UTC"`)
+	assert.Contains(t, messages[1], `"created_at":"2021-02-19 15:04:07 +0000 UTC"`)
+	assert.Contains(t, messages[1], `FROM accounts`)
+}
+
+func TestReplayer_LogTimezone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "postgresql.log")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`2021-01-11 15:25:36 EST [56193-3/9939-5706] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 1
+2021-07-11 15:25:36.250 EDT [56193-3/9939-5707] app@ledger LOG:  duration: 1.000 ms  statement: SELECT 2
+`), 0644))
+
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.Nil(t, err)
+	logTimezone = newYork
+	defer func() { logTimezone = time.Local }()
+
+	_, messages := replayToBuffer(t, path)
+	assert.Len(t, messages, 2)
+	assert.Contains(t, messages[0], `"created_at":"2021-01-11 20:25:36 +0000 UTC"`)
+	assert.Contains(t, messages[1], `"created_at":"2021-07-11 19:25:36.25 +0000 UTC"`)
+}
+
+func TestReplayer_GzipFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte(replayLog))
+	writer.Close()
+
+	path := filepath.Join(dir, "postgresql.log.gz")
+	assert.Nil(t, ioutil.WriteFile(path, compressed.Bytes(), 0644))
+
+	replayer, messages := replayToBuffer(t, path)
+	assert.Equal(t, ReplaySummary{Files: 1, Parsed: 2, Skipped: 1}, replayer.Summary)
+	assert.Len(t, messages, 2)
+}
+
+func TestReplayer_ZstdFile(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "postgresql.log")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(replayLog), 0644))
+	assert.Nil(t, exec.Command("zstd", "-q", "--rm", path).Run())
+
+	replayer, messages := replayToBuffer(t, path+".zst")
+	assert.Equal(t, ReplaySummary{Files: 1, Parsed: 2, Skipped: 1}, replayer.Summary)
+	assert.Len(t, messages, 2)
+}
+
+func TestReplayer_WaitsForBatchedSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	entries := new(bytes.Buffer)
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(entries, "2021-02-19 15:04:05 UTC [56193-3/9939-%d] app@ledger LOG:  duration: 1.000 ms  statement: SELECT %d\n", i, i)
+	}
+	path := filepath.Join(dir, "postgresql.log")
+	assert.Nil(t, ioutil.WriteFile(path, entries.Bytes(), 0644))
+
+	server := newRecordingServer(bulkIndexed)
+	defer server.Close()
+	server.setDelay(5 * time.Millisecond)
+
+	// The queue holds ten batches, a fifth of the file, as replayMain sets up.
+	defaults := elasticsearchOptions
+	elasticsearchOptions.BatchSize = 10
+	batchedSinkBlocking = true
+	defer func() {
+		elasticsearchOptions = defaults
+		batchedSinkBlocking = false
+	}()
+	sink, err := OpenSink("elasticsearch:" + server.URL)
+	assert.Nil(t, err)
+
+	replayer := &Replayer{InputFormat: "stderr", Prefix: MustLogLinePrefix(DefaultLogLinePrefix)}
+	assert.Nil(t, replayer.ReplayFile(path, sink))
+	assert.Nil(t, sink.Close())
+	assert.Equal(t, ReplaySummary{Files: 1, Parsed: 500}, replayer.Summary)
+
+	indexed := 0
+	_, bodies := server.received()
+	for _, body := range bodies {
+		indexed += strings.Count(string(body), `"_index"`)
+	}
+	assert.Equal(t, 500, indexed)
+}
+
+func TestReplayer_MissingFile(t *testing.T) {
+	replayer := &Replayer{InputFormat: "stderr", Prefix: MustLogLinePrefix(DefaultLogLinePrefix)}
+	assert.NotNil(t, replayer.ReplayFile("/does/not/exist.log", NewWriterSink(new(lockedBuffer))))
+	assert.Equal(t, 0, replayer.Summary.Files)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ie: "connection authorized: user=app database=ledger application_name=psql SSL enabled (protocol=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256)"
+	RegexConnectionAuthorized = regexp.MustCompile(`^(?:replication )?connection authorized: `)
+	RegexConnectionUser       = regexp.MustCompile(`\buser=(\S+)`)
+	RegexConnectionDatabase   = regexp.MustCompile(`\bdatabase=(\S+)`)
+	RegexConnectionAppName    = regexp.MustCompile(`\bapplication_name=(.+?)(?: SSL enabled| GSS \(|$)`)
+	RegexConnectionSSL        = regexp.MustCompile(`SSL enabled \(protocol=([^,]+), cipher=([^,]+), bits=(\d+)`)
+	// ie: "disconnection: session time: 0:00:01.234 user=app database=ledger host=10.0.0.5 port=51234"
+	RegexDisconnection = regexp.MustCompile(`^disconnection: session time: (\d+):(\d+):([\d.]+) user=(\S*) database=(\S*) host=(\S*)(?: port=(\d+))?`)
+)
+
+// sessionLogType returns "connection" or "disconnection" for the entries
+// written by log_connections and log_disconnections, or an empty string for
+// anything else.
+func sessionLogType(logLine *PostgresLogLine) string {
+	if RegexConnectionAuthorized.MatchString(logLine.Message) {
+		return "connection"
+	}
+	if RegexDisconnection.MatchString(logLine.Message) {
+		return "disconnection"
+	}
+	return ""
+}
+
+type SessionMessage struct {
+	Event                    string  `json:"event"`
+	Username                 string  `json:"username"`
+	Database                 string  `json:"database"`
+	ClientHost               string  `json:"client_host,omitempty"`
+	ClientPort               string  `json:"client_port,omitempty"`
+	ApplicationName          string  `json:"application_name,omitempty"`
+	SSL                      bool    `json:"ssl"`
+	SSLProtocol              string  `json:"ssl_protocol,omitempty"`
+	SSLCipher                string  `json:"ssl_cipher,omitempty"`
+	SSLBits                  int     `json:"ssl_bits,omitempty"`
+	SessionDurationInSeconds float64 `json:"session_duration_in_seconds,omitempty"`
+	PID                      int     `json:"pid,omitempty"`
+	CreatedAt                string  `json:"created_at"`
+	Type                     string  `json:"type"`
+	HostName                 string  `json:"hostname"`
+	TimberVersion            string  `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// ParseSession parses a "connection authorized" or "disconnection" entry. The
+// client host of a new connection comes from %h or %r in the log_line_prefix.
+func ParseSession(logLine *PostgresLogLine) *SessionMessage {
+	message := logLine.Message
+	msg := &SessionMessage{
+		Username:        logLine.Username,
+		Database:        logLine.Database,
+		ClientHost:      logLine.RemoteHost,
+		ClientPort:      logLine.RemotePort,
+		ApplicationName: logLine.ApplicationName,
+		PID:             logLine.PID,
+		CreatedAt:       logLine.CreatedAt(),
+		Type:            "timber.postgres_session",
+		HostName:        logLine.HostName(),
+		TimberVersion:   TimberVersion(),
+		SourceMetadata:  logLine.Source,
+	}
+
+	switch logLine.LogType {
+	case "connection":
+		msg.Event = "connect"
+		if match := RegexConnectionUser.FindStringSubmatch(message); match != nil {
+			msg.Username = match[1]
+		}
+		if match := RegexConnectionDatabase.FindStringSubmatch(message); match != nil {
+			msg.Database = match[1]
+		}
+		if match := RegexConnectionAppName.FindStringSubmatch(message); match != nil {
+			msg.ApplicationName = match[1]
+		}
+		if match := RegexConnectionSSL.FindStringSubmatch(message); match != nil {
+			msg.SSL = true
+			msg.SSLProtocol = match[1]
+			msg.SSLCipher = match[2]
+			msg.SSLBits, _ = strconv.Atoi(match[3])
+		}
+	case "disconnection":
+		msg.Event = "disconnect"
+		if match := RegexDisconnection.FindStringSubmatch(message); match != nil {
+			hours, _ := strconv.ParseFloat(match[1], 64)
+			minutes, _ := strconv.ParseFloat(match[2], 64)
+			seconds, _ := strconv.ParseFloat(match[3], 64)
+			msg.SessionDurationInSeconds = hours*3600 + minutes*60 + seconds
+			msg.Username = match[4]
+			msg.Database = match[5]
+			msg.ClientHost = match[6]
+			msg.ClientPort = match[7]
+		}
+	}
+
+	return msg
+}
+
+func LogSession(logLine *PostgresLogLine, sink Sink) {
+	msg := ParseSession(logLine)
+	if sessionCounter != nil && msg.Event == "connect" {
+		sessionCounter.Add(logLine.Source, msg.Username, msg.Database)
+	}
+	SendMessage(msg, sink)
+}
+
+// sessionCounter is set when connection counts are reported per interval.
+var sessionCounter *SessionCounter
+
+type sessionCountKey struct {
+	source   string
+	cluster  string
+	username string
+	database string
+}
+
+// SessionCounter counts new connections by user and database so that a
+// connection storm from a single service stands out.
+type SessionCounter struct {
+	interval time.Duration
+
+	mutex  sync.Mutex
+	counts map[sessionCountKey]int
+}
+
+func NewSessionCounter(interval time.Duration) *SessionCounter {
+	return &SessionCounter{
+		interval: interval,
+		counts:   make(map[sessionCountKey]int),
+	}
+}
+
+type SessionCountMessage struct {
+	Source            string  `json:"source,omitempty"`
+	Cluster           string  `json:"cluster,omitempty"`
+	Username          string  `json:"username"`
+	Database          string  `json:"database"`
+	Connections       int     `json:"connections"`
+	IntervalInSeconds float64 `json:"interval_in_seconds"`
+	CreatedAt         string  `json:"created_at"`
+	Type              string  `json:"type"`
+	HostName          string  `json:"hostname"`
+	TimberVersion     string  `json:"timber_version"`
+}
+
+// Add counts a connection. Connections to different named sources are counted
+// separately.
+func (self *SessionCounter) Add(source *SourceMetadata, username string, database string) {
+	key := sessionCountKey{username: username, database: database}
+	if source != nil {
+		key.source, key.cluster = source.Name, source.Cluster
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.counts[key]++
+}
+
+// Counts returns a message for every user and database that connected since
+// the last call, and resets the counts.
+func (self *SessionCounter) Counts() []*SessionCountMessage {
+	self.mutex.Lock()
+	counts := self.counts
+	self.counts = make(map[sessionCountKey]int)
+	self.mutex.Unlock()
+
+	msgs := []*SessionCountMessage{}
+	for key, count := range counts {
+		msgs = append(msgs, &SessionCountMessage{
+			Source:            key.source,
+			Cluster:           key.cluster,
+			Username:          key.username,
+			Database:          key.database,
+			Connections:       count,
+			IntervalInSeconds: self.interval.Seconds(),
+			CreatedAt:         time.Now().UTC().String(),
+			Type:              "timber.postgres_session_count",
+			HostName:          HostName(),
+			TimberVersion:     TimberVersion(),
+		})
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Source != msgs[j].Source {
+			return msgs[i].Source < msgs[j].Source
+		}
+		if msgs[i].Cluster != msgs[j].Cluster {
+			return msgs[i].Cluster < msgs[j].Cluster
+		}
+		if msgs[i].Username != msgs[j].Username {
+			return msgs[i].Username < msgs[j].Username
+		}
+		return msgs[i].Database < msgs[j].Database
+	})
+	return msgs
+}
+
+// Start sends the connection counts to sink once every interval.
+func (self *SessionCounter) Start(sink Sink) {
+	go func() {
+		ticker := time.NewTicker(self.interval)
+		for range ticker.C {
+			for _, msg := range self.Counts() {
+				SendMessage(msg, sink)
+			}
+		}
+	}()
+}
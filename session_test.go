@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingSessionLifecycle(t *testing.T) {
+	log := `2021-03-13 11:45:00.123 UTC [4242] 10.0.0.5(51234) [unknown]@[unknown] LOG:  connection received: host=10.0.0.5 port=51234
+2021-03-13 11:45:00.130 UTC [4242] 10.0.0.5(51234) app@ledger LOG:  connection authorized: user=app database=ledger application_name=PostgreSQL JDBC Driver SSL enabled (protocol=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256)
+2021-03-13 11:45:01.364 UTC [4242] 10.0.0.5(51234) app@ledger LOG:  disconnection: session time: 1:02:03.234 user=app database=ledger host=10.0.0.5 port=51234
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParserWithPrefix(scanner, MustLogLinePrefix("%m [%p] %r %q%u@%d "))
+
+	_, err := logParser.Parse()
+	assert.Equal(t, ErrInvalidLogLine, err)
+
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "connection", pgLog.LogType)
+
+	msg := ParseSession(pgLog)
+	assert.Equal(t, "timber.postgres_session", msg.Type)
+	assert.Equal(t, "connect", msg.Event)
+	assert.Equal(t, "app", msg.Username)
+	assert.Equal(t, "ledger", msg.Database)
+	assert.Equal(t, "10.0.0.5", msg.ClientHost)
+	assert.Equal(t, "51234", msg.ClientPort)
+	assert.Equal(t, "PostgreSQL JDBC Driver", msg.ApplicationName)
+	assert.True(t, msg.SSL)
+	assert.Equal(t, "TLSv1.3", msg.SSLProtocol)
+	assert.Equal(t, "TLS_AES_256_GCM_SHA384", msg.SSLCipher)
+	assert.Equal(t, 256, msg.SSLBits)
+
+	pgLog, err = logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "disconnection", pgLog.LogType)
+
+	msg = ParseSession(pgLog)
+	assert.Equal(t, "disconnect", msg.Event)
+	assert.Equal(t, "app", msg.Username)
+	assert.Equal(t, "10.0.0.5", msg.ClientHost)
+	assert.False(t, msg.SSL)
+	assert.InDelta(t, 3723.234, msg.SessionDurationInSeconds, 0.0001)
+}
+
+func TestSessionCounter(t *testing.T) {
+	counter := NewSessionCounter(time.Minute)
+	counter.Add(nil, "app", "ledger")
+	counter.Add(nil, "app", "ledger")
+	counter.Add(nil, "worker", "ledger")
+
+	counts := counter.Counts()
+	assert.Len(t, counts, 2)
+	assert.Equal(t, "app", counts[0].Username)
+	assert.Equal(t, 2, counts[0].Connections)
+	assert.Equal(t, "worker", counts[1].Username)
+	assert.Equal(t, 1, counts[1].Connections)
+	assert.Equal(t, 60.0, counts[1].IntervalInSeconds)
+	assert.Equal(t, "timber.postgres_session_count", counts[1].Type)
+
+	assert.Len(t, counter.Counts(), 0)
+}
+
+func TestSessionCounter_Sources(t *testing.T) {
+	counter := NewSessionCounter(time.Minute)
+	counter.Add(&SourceMetadata{Name: "replica", Cluster: "ledger"}, "app", "ledger")
+	counter.Add(&SourceMetadata{Name: "main", Cluster: "ledger"}, "app", "ledger")
+	counter.Add(&SourceMetadata{Name: "main", Cluster: "ledger"}, "app", "ledger")
+
+	counts := counter.Counts()
+	assert.Len(t, counts, 2)
+	assert.Equal(t, "main", counts[0].Source)
+	assert.Equal(t, "ledger", counts[0].Cluster)
+	assert.Equal(t, 2, counts[0].Connections)
+	assert.Equal(t, "replica", counts[1].Source)
+	assert.Equal(t, 1, counts[1].Connections)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/pretty"
+)
+
+// Event is a message on its way to the sinks, along with its json encoding,
+// decoded once for the sinks that look inside it.
+type Event struct {
+	Message interface{}
+	Payload []byte
+
+	fields    map[string]interface{}
+	createdAt time.Time
+}
+
+func NewEvent(msg interface{}) (*Event, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &Event{Message: msg, Payload: payload, createdAt: time.Now().UTC()}
+	json.Unmarshal(payload, &event.fields)
+	if createdAt, ok := event.fields["created_at"].(string); ok {
+		// The format of time.Time.String, which messages are dated with.
+		t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", createdAt)
+		if err == nil {
+			event.createdAt = t
+		}
+	}
+	return event, nil
+}
+
+// Fields returns the fields of the json of the event, in a map the caller can
+// change.
+func (self *Event) Fields() map[string]interface{} {
+	fields := make(map[string]interface{}, len(self.fields))
+	for key, value := range self.fields {
+		fields[key] = value
+	}
+	return fields
+}
+
+// CreatedAt is the created_at of the message, or when the event was created
+// when it has none.
+func (self *Event) CreatedAt() time.Time {
+	return self.createdAt
+}
+
+// Sink is somewhere messages are sent. Write may queue the event, Flush waits
+// until what was queued has been sent, and Close flushes and lets go of the
+// sink.
+type Sink interface {
+	Write(ctx context.Context, event *Event) error
+	Flush() error
+	Close() error
+}
+
+// SinkFactory opens a sink given what follows its name in a sink spec, ie:
+// "logstash:5000" for "tcp:logstash:5000".
+type SinkFactory func(target string) (Sink, error)
+
+var (
+	sinkFactoriesMutex sync.Mutex
+	sinkFactories      = make(map[string]SinkFactory)
+
+	// Set when replaying, so tcp sinks wait for room instead of dropping messages.
+	tcpSinkBlocking bool
+	// Set when replaying, so the sinks that send in batches wait for room in
+	// their queue instead of dropping messages.
+	batchedSinkBlocking bool
+	// How tcp sinks connect.
+	tcpSinkTLSOptions = DefaultTLSOptions()
+)
+
+func init() {
+	RegisterSink("stdout", func(target string) (Sink, error) {
+		return NewStdoutSink(), nil
+	})
+	RegisterSink("syslog", func(target string) (Sink, error) {
+		return NewSyslogSink(target), nil
+	})
+	RegisterSink("tcp", func(target string) (Sink, error) {
+		if target == "" {
+			return nil, errors.New("the tcp sink needs an address, ie: tcp:logstash:5000")
+		}
+		tlsConfig, err := tcpSinkTLSOptions.Config()
+		if err != nil {
+			return nil, err
+		}
+		tcpLogger, err := DialTCPLoggerWithTLS(target, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		tcpLogger.blocking = tcpSinkBlocking
+		return NewWriterSink(tcpLogger), nil
+	})
+}
+
+// RegisterSink makes a sink implementation available to OpenSink by name.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactoriesMutex.Lock()
+	defer sinkFactoriesMutex.Unlock()
+	sinkFactories[name] = factory
+}
+
+// SinkNames returns the names of the registered sinks.
+func SinkNames() []string {
+	sinkFactoriesMutex.Lock()
+	defer sinkFactoriesMutex.Unlock()
+
+	names := []string{}
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenSink opens a sink from a spec like "stdout" or "tcp:logstash:5000", its
+// name optionally followed by a colon and a target.
+func OpenSink(spec string) (Sink, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	name, target := parts[0], ""
+	if len(parts) == 2 {
+		target = parts[1]
+	}
+
+	sinkFactoriesMutex.Lock()
+	factory, ok := sinkFactories[name]
+	sinkFactoriesMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q, the sinks are: %s", name, strings.Join(SinkNames(), ", "))
+	}
+	return factory(target)
+}
+
+// OpenSinks opens every spec and fans out to all of them. Without any specs,
+// messages go to tcpOutUrl when it is set or to syslog otherwise, and are
+// printed to stdout.
+func OpenSinks(specs []string, tcpOutUrl string) (Sink, error) {
+	if len(specs) == 0 {
+		specs = []string{"syslog", "stdout"}
+		if tcpOutUrl != "" {
+			specs[0] = "tcp:" + tcpOutUrl
+		}
+	}
+
+	sinks := MultiSink{}
+	for _, spec := range specs {
+		sink, err := OpenSink(spec)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("could not open the %s sink: %v", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// MultiSink writes every event to all of its sinks. One failing sink does not
+// keep the event from the others.
+type MultiSink []Sink
+
+func (self MultiSink) Write(ctx context.Context, event *Event) error {
+	var err error
+	for _, sink := range self {
+		if writeErr := sink.Write(ctx, event); err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+func (self MultiSink) Flush() error {
+	var err error
+	for _, sink := range self {
+		if flushErr := sink.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (self MultiSink) Close() error {
+	var err error
+	for _, sink := range self {
+		if closeErr := sink.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// WriterSink writes the json of every event to an io.Writer, like a TCPLogger
+// or a buffer, and closes it when it can be closed.
+type WriterSink struct {
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (self *WriterSink) Write(ctx context.Context, event *Event) error {
+	_, err := self.writer.Write(event.Payload)
+	return err
+}
+
+func (self *WriterSink) Flush() error {
+	return nil
+}
+
+func (self *WriterSink) Close() error {
+	switch writer := self.writer.(type) {
+	case io.Closer:
+		return writer.Close()
+	case interface{ Close() }:
+		writer.Close()
+	}
+	return nil
+}
+
+// StdoutSink prints every message, as timber always has.
+type StdoutSink struct{}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (self *StdoutSink) Write(ctx context.Context, event *Event) error {
+	_, err := pretty.Println(string(event.Payload))
+	return err
+}
+
+func (self *StdoutSink) Flush() error {
+	return nil
+}
+
+func (self *StdoutSink) Close() error {
+	return nil
+}
+
+// SyslogSink sends messages to the local syslog with the LOCAL1 facility. The
+// connection is only opened by the first message, so hosts without syslog can
+// run timber with other sinks.
+type SyslogSink struct {
+	tag string
+
+	mutex  sync.Mutex
+	writer *syslog.Writer
+}
+
+// NewSyslogSink tags messages with tag, or "timber" when it is empty.
+func NewSyslogSink(tag string) *SyslogSink {
+	if tag == "" {
+		tag = "timber"
+	}
+	return &SyslogSink{tag: tag}
+}
+
+func (self *SyslogSink) Write(ctx context.Context, event *Event) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.writer == nil {
+		writer, err := syslog.New(syslog.LOG_LOCAL1|syslog.LOG_INFO, self.tag)
+		if err != nil {
+			return err
+		}
+		self.writer = writer
+	}
+	_, err := self.writer.Write(event.Payload)
+	return err
+}
+
+func (self *SyslogSink) Flush() error {
+	return nil
+}
+
+func (self *SyslogSink) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.writer == nil {
+		return nil
+	}
+	err := self.writer.Close()
+	self.writer = nil
+	return err
+}
+
+type batcherOptions struct {
+	// A batch is sent once it has this many items or bytes, or once the flush
+	// interval has passed. Without BatchBytes, only the items are counted.
+	BatchSize     int
+	BatchBytes    int
+	FlushInterval time.Duration
+	// How many times the items a send failed for are sent again, waiting
+	// RetryBackoff longer each time.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// batchItem is something queued for a batcher, and how many bytes it adds to a
+// request.
+type batchItem struct {
+	value interface{}
+	size  int
+}
+
+// batcher queues what a sink writes and sends it in batches from a goroutine,
+// for sinks that make one request for many messages. The sink only knows how
+// to send a batch, and returns the items worth sending again.
+type batcher struct {
+	name    string
+	options batcherOptions
+	send    func(batch []interface{}) ([]interface{}, error)
+
+	mutex        sync.Mutex
+	pending      []batchItem
+	pendingBytes int
+
+	// When blocking, add waits for room in the queue, which a flush signals.
+	blocking bool
+	room     *sync.Cond
+
+	// Only one batch is sent at a time.
+	sendMutex sync.Mutex
+
+	ticker    *time.Ticker
+	flushNow  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatcher(name string, options batcherOptions, send func(batch []interface{}) ([]interface{}, error)) *batcher {
+	batcher := &batcher{
+		name:     name,
+		options:  options,
+		send:     send,
+		blocking: batchedSinkBlocking,
+		ticker:   time.NewTicker(options.FlushInterval),
+		flushNow: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	batcher.room = sync.NewCond(&batcher.mutex)
+	go batcher.flushPeriodically()
+	return batcher
+}
+
+// add queues an item, and has the batch sent once it is full. Items are
+// dropped while the queue holds ten batches that could not be sent, unless the
+// batcher is blocking, in which case add waits until they have been.
+func (self *batcher) add(value interface{}, size int) error {
+	self.mutex.Lock()
+	for self.blocking && len(self.pending) >= 10*self.options.BatchSize && !self.isClosed() {
+		self.signalFlush()
+		self.room.Wait()
+	}
+	if len(self.pending) >= 10*self.options.BatchSize {
+		self.mutex.Unlock()
+		return fmt.Errorf("the %s queue is full", self.name)
+	}
+	self.pending = append(self.pending, batchItem{value: value, size: size})
+	self.pendingBytes += size
+	full := len(self.pending) >= self.options.BatchSize ||
+		(self.options.BatchBytes > 0 && self.pendingBytes >= self.options.BatchBytes)
+	self.mutex.Unlock()
+
+	if full {
+		self.signalFlush()
+	}
+	return nil
+}
+
+func (self *batcher) signalFlush() {
+	select {
+	case self.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+func (self *batcher) isClosed() bool {
+	select {
+	case <-self.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flush sends what is queued, in as many batches as it takes.
+func (self *batcher) Flush() error {
+	self.sendMutex.Lock()
+	defer self.sendMutex.Unlock()
+
+	self.mutex.Lock()
+	pending := self.pending
+	self.pending = nil
+	self.pendingBytes = 0
+	if self.room != nil {
+		self.room.Broadcast()
+	}
+	self.mutex.Unlock()
+
+	var err error
+	for len(pending) > 0 {
+		size := self.batchSize(pending)
+		batch := make([]interface{}, size)
+		for i, item := range pending[:size] {
+			batch[i] = item.value
+		}
+
+		sendErr := self.sendWithRetries(batch)
+		if sendErr != nil && err == nil {
+			err = sendErr
+		}
+		pending = pending[size:]
+	}
+	return err
+}
+
+// batchSize returns how many of the items go in the next batch, as many as fit
+// in BatchSize and BatchBytes but at least one.
+func (self *batcher) batchSize(items []batchItem) int {
+	size, bytes := 0, 0
+	for size < len(items) && size < self.options.BatchSize {
+		bytes += items[size].size
+		if size > 0 && self.options.BatchBytes > 0 && bytes > self.options.BatchBytes {
+			break
+		}
+		size++
+	}
+	return size
+}
+
+func (self *batcher) sendWithRetries(batch []interface{}) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := self.send(batch)
+		if len(retry) == 0 {
+			return err
+		}
+		if attempt >= self.options.MaxRetries {
+			log.Println("Dropping", len(retry), "message(s) that could not be sent to", self.name, "after", attempt+1, "attempts")
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * self.options.RetryBackoff)
+		batch = retry
+	}
+}
+
+func (self *batcher) flushPeriodically() {
+	for {
+		select {
+		case <-self.ticker.C:
+		case <-self.flushNow:
+		case <-self.closed:
+			return
+		}
+
+		err := self.Flush()
+		if err != nil {
+			log.Printf("Could not send to %s: %v\n", self.name, err)
+		}
+	}
+}
+
+// Close stops the periodic flushes and sends what is queued.
+func (self *batcher) Close() error {
+	self.closeOnce.Do(func() {
+		self.ticker.Stop()
+		self.mutex.Lock()
+		close(self.closed)
+		self.room.Broadcast()
+		self.mutex.Unlock()
+	})
+	return self.Flush()
+}
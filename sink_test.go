@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the payloads written to it, failing every write when err
+// is set.
+type recordingSink struct {
+	payloads []string
+	err      error
+	flushed  int
+	closed   bool
+}
+
+func (self *recordingSink) Write(ctx context.Context, event *Event) error {
+	if self.err != nil {
+		return self.err
+	}
+	self.payloads = append(self.payloads, string(event.Payload))
+	return nil
+}
+
+func (self *recordingSink) Flush() error {
+	self.flushed++
+	return nil
+}
+
+func (self *recordingSink) Close() error {
+	self.closed = true
+	return nil
+}
+
+// cannedResponse is how a recordingServer answers a request.
+type cannedResponse struct {
+	status int
+	body   string
+}
+
+// recordingServer keeps the requests the http sinks make, and answers each with
+// the next of its responses, or with the fallback once it runs out. Each answer
+// takes delay, like a busy cluster.
+type recordingServer struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	requests  []*http.Request
+	bodies    [][]byte
+	fallback  cannedResponse
+	responses []cannedResponse
+	delay     time.Duration
+}
+
+func newRecordingServer(fallback cannedResponse, responses ...cannedResponse) *recordingServer {
+	server := &recordingServer{fallback: fallback, responses: responses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		server.mutex.Lock()
+		delay := server.delay
+		server.mutex.Unlock()
+		time.Sleep(delay)
+
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.requests = append(server.requests, r)
+		server.bodies = append(server.bodies, b)
+
+		response := server.fallback
+		if len(server.responses) > 0 {
+			response, server.responses = server.responses[0], server.responses[1:]
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	return server
+}
+
+func (self *recordingServer) setDelay(delay time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.delay = delay
+}
+
+// received returns the requests so far, and their bodies.
+func (self *recordingServer) received() ([]*http.Request, [][]byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]*http.Request{}, self.requests...), append([][]byte{}, self.bodies...)
+}
+
+func TestNewEvent(t *testing.T) {
+	event, err := NewEvent(map[string]interface{}{
+		"created_at": "2021-02-19 15:04:05.123 +0000 UTC",
+		"query":      "SELECT 1",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2021, 2, 19, 15, 4, 5, 123000000, time.UTC), event.CreatedAt().UTC())
+
+	// Every caller gets fields of its own.
+	fields := event.Fields()
+	delete(fields, "query")
+	assert.Equal(t, "SELECT 1", event.Fields()["query"])
+
+	event, err = NewEvent(map[string]string{"type": "timber.test"})
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), event.CreatedAt(), time.Minute)
+}
+
+func TestMultiSink(t *testing.T) {
+	failing := &recordingSink{err: errors.New("unreachable")}
+	working := &recordingSink{}
+	sinks := MultiSink{failing, working}
+
+	event, err := NewEvent(map[string]string{"type": "timber.test"})
+	assert.Nil(t, err)
+
+	// The failing sink does not keep the event from the other one.
+	assert.Equal(t, failing.err, sinks.Write(context.Background(), event))
+	assert.Equal(t, []string{`{"type":"timber.test"}`}, working.payloads)
+
+	assert.Nil(t, sinks.Flush())
+	assert.Nil(t, sinks.Close())
+	assert.Equal(t, 1, working.flushed)
+	assert.True(t, failing.closed)
+	assert.True(t, working.closed)
+}
+
+func TestOpenSink(t *testing.T) {
+	recording := &recordingSink{}
+	RegisterSink("recording", func(target string) (Sink, error) {
+		assert.Equal(t, "some:target", target)
+		return recording, nil
+	})
+	defer func() {
+		sinkFactoriesMutex.Lock()
+		delete(sinkFactories, "recording")
+		sinkFactoriesMutex.Unlock()
+	}()
+
+	sink, err := OpenSink("recording:some:target")
+	assert.Nil(t, err)
+	assert.Equal(t, recording, sink)
+
+	_, err = OpenSink("carrier-pigeon")
+	assert.EqualError(t, err, `unknown sink "carrier-pigeon", the sinks are: elasticsearch, loki, opensearch, otlp, recording, stdout, syslog, tcp`)
+
+	_, err = OpenSink("tcp")
+	assert.NotNil(t, err)
+}
+
+func TestOpenSinks_TCPOutUrl(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	sink, err := OpenSinks(nil, listener.Addr().String())
+	assert.Nil(t, err)
+	assert.Len(t, sink, 2)
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	SendMessage(map[string]string{"type": "timber.test"}, sink)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"type\":\"timber.test\"}\r\n", line)
+	assert.Nil(t, sink.Close())
+}
+
+func TestSyslogSink_OpensLazily(t *testing.T) {
+	// Nothing is opened until the first message, so closing an unused sink
+	// works on hosts without syslog.
+	sink := NewSyslogSink("")
+	assert.Equal(t, "timber", sink.tag)
+	assert.Nil(t, sink.writer)
+	assert.Nil(t, sink.Close())
+}
+
+func TestWriterSink(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	sink := NewWriterSink(buffer)
+
+	SendMessage(map[string]int{"calls": 2}, sink)
+	assert.Equal(t, `{"calls":2}`, buffer.String())
+	assert.Nil(t, sink.Flush())
+	assert.Nil(t, sink.Close())
+}
+
+func TestBatcher(t *testing.T) {
+	sent := [][]interface{}{}
+	retried := false
+	// Without the goroutine that flushes, so only Flush sends.
+	batcher := &batcher{
+		name: "test",
+		options: batcherOptions{
+			BatchSize:    3,
+			BatchBytes:   10,
+			MaxRetries:   1,
+			RetryBackoff: time.Millisecond,
+		},
+		send: func(batch []interface{}) ([]interface{}, error) {
+			sent = append(sent, batch)
+			if batch[0] == "busy" && !retried {
+				retried = true
+				return batch[:1], errors.New("busy")
+			}
+			return nil, nil
+		},
+		flushNow: make(chan struct{}, 1),
+	}
+
+	// Batches are cut at three items or ten bytes, and the items a batch is
+	// sent again for make up a batch of their own.
+	for _, item := range []string{"busy", "a", "b", "c", "a longer line"} {
+		assert.Nil(t, batcher.add(item, len(item)))
+	}
+	assert.Nil(t, batcher.Flush())
+	assert.Equal(t, [][]interface{}{{"busy", "a", "b"}, {"busy"}, {"c"}, {"a longer line"}}, sent)
+
+	// Items are dropped while the queue holds ten batches.
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, batcher.add(i, 0))
+	}
+	assert.EqualError(t, batcher.add(30, 0), "the test queue is full")
+}
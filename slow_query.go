@@ -1,14 +1,9 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
 	"regexp"
 	"strings"
 	"time"
-
-	"github.com/kr/pretty"
 )
 
 var (
@@ -47,6 +42,24 @@ func scrubChecker(st string) string {
 	return sql
 }
 
+// ScrubBindParameters scrubs bind parameter values the same way ScrubQuery
+// scrubs string literals in a query.
+func ScrubBindParameters(params BindParameters) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+
+	scrubbed := make(map[string]string, len(params))
+	for placeholder, value := range params {
+		if value == "NULL" {
+			scrubbed[placeholder] = value
+		} else {
+			scrubbed[placeholder] = scrubChecker(value)
+		}
+	}
+	return scrubbed
+}
+
 func ParseShardFromValue(value string) string {
 	// This assumes a query has only one schema.
 	// Multi-schema queries will not be parsed correctly.
@@ -84,9 +97,43 @@ type SlowQueryMessage struct {
 	Type                   string  `json:"type"`
 	HostName               string  `json:"hostname"`
 	TimberVersion          string  `json:"timber_version"`
+
+	Parameters map[string]string `json:"parameters,omitempty"`
+	SampleRate float64           `json:"sample_rate"`
+
+	*SourceMetadata
+}
+
+// DurationSampling mirrors the postgresql.conf settings that decide whether a
+// statement's duration is always logged or only logged for a sample.
+// Durations are in milliseconds and -1 disables the setting, like postgres.
+type DurationSampling struct {
+	MinDurationStatement int
+	MinDurationSample    int
+	StatementSampleRate  float64
+}
+
+var durationSampling = DurationSampling{
+	MinDurationStatement: -1,
+	MinDurationSample:    -1,
+	StatementSampleRate:  1.0,
+}
+
+// SampleRate returns the fraction of statements with this duration that
+// postgres logs. Durations at or above log_min_duration_statement are always
+// logged; durations between log_min_duration_sample and that are sampled.
+func (self DurationSampling) SampleRate(duration time.Duration) float64 {
+	milliseconds := float64(duration.Microseconds()) / 1000.0
+	if self.MinDurationStatement >= 0 && milliseconds >= float64(self.MinDurationStatement) {
+		return 1.0
+	}
+	if self.MinDurationSample >= 0 && milliseconds >= float64(self.MinDurationSample) {
+		return self.StatementSampleRate
+	}
+	return 1.0
 }
 
-func LogSlowQuery(logLine *PostgresLogLine, logger io.Writer) {
+func ParseSlowQuery(logLine *PostgresLogLine) *SlowQueryMessage {
 	shardName, shardlessQuery := DerivedValues(logLine.Value)
 
 	msg := &SlowQueryMessage{
@@ -97,22 +144,18 @@ func LogSlowQuery(logLine *PostgresLogLine, logger io.Writer) {
 		ShardName:              shardName,
 		ShardlessQuery:         ScrubQuery(shardlessQuery),
 		DurationInMilliseconds: float64(logLine.Duration.Microseconds()) / 1000.0,
-		CreatedAt:              time.Now().UTC().String(),
+		CreatedAt:              logLine.CreatedAt(),
 		Type:                   "timber.postgres_slow_query",
-		HostName:               HostName(),
+		HostName:               logLine.HostName(),
 		TimberVersion:          TimberVersion(),
+		Parameters:             ScrubBindParameters(logLine.Parameters),
+		SampleRate:             durationSampling.SampleRate(logLine.Duration),
+		SourceMetadata:         logLine.Source,
 	}
 
-	bytes, err := json.Marshal(msg)
-	if err != nil {
-		fmt.Println("Could not encoding the slow query log as json:", err)
-		return
-	}
+	return msg
+}
 
-	if logger != nil {
-		logger.Write(bytes)
-	} else {
-		SendToKibana(bytes)
-	}
-	pretty.Println(string(bytes))
+func LogSlowQuery(logLine *PostgresLogLine, sink Sink) {
+	SendMessage(ParseSlowQuery(logLine), sink)
 }
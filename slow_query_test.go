@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -160,3 +161,42 @@ func TestParsingFullQuery(t *testing.T) {
 
 	assert.Equal(t, `SELECT  "transactions"."guid" FROM "transactions" WHERE ("transactions"."date" BETWEEN '2021-03-13 11:45:00.000000' AND '2021-03-13 12:15:00.000000') AND "transactions"."account_id" = 252641 AND "transactions"."amount" = 'xxx' AND "transactions"."is_deleted" = 'f' AND "transactions"."status" = 1 AND "transactions"."transaction_type" = 2 AND "transactions"."user_guid" = 'USR-f164af58-bb51-47ed-aa35-368ae3f46648' AND "transactions"."merchant_guid" IS NULL AND "transactions"."parent_id" IS NULL AND "transactions"."description" = 'xxx'  ORDER BY "transactions"."id" ASC LIMIT 10`, scrubbedQuery)
 }
+
+func TestScrubBindParameters(t *testing.T) {
+	params := BindParameters{
+		"$1": `'USR-f164af58-bb51-47ed-aa35-368ae3f46648'`,
+		"$2": `'Children''s Hospital'`,
+		"$3": "NULL",
+		"$4": `'t'`,
+	}
+
+	scrubbed := ScrubBindParameters(params)
+	assert.Equal(t, map[string]string{
+		"$1": `'USR-f164af58-bb51-47ed-aa35-368ae3f46648'`,
+		"$2": `'xxx'`,
+		"$3": "NULL",
+		"$4": `'t'`,
+	}, scrubbed)
+
+	assert.Nil(t, ScrubBindParameters(nil))
+}
+
+func TestDurationSamplingSampleRate(t *testing.T) {
+	sampling := DurationSampling{
+		MinDurationStatement: 1000,
+		MinDurationSample:    100,
+		StatementSampleRate:  0.25,
+	}
+
+	assert.Equal(t, 1.0, sampling.SampleRate(1500*time.Millisecond))
+	assert.Equal(t, 1.0, sampling.SampleRate(1000*time.Millisecond))
+	assert.Equal(t, 0.25, sampling.SampleRate(250*time.Millisecond))
+	assert.Equal(t, 1.0, sampling.SampleRate(50*time.Millisecond))
+
+	// Without log_min_duration_statement everything above the sample threshold is sampled.
+	sampling.MinDurationStatement = -1
+	assert.Equal(t, 0.25, sampling.SampleRate(5*time.Second))
+
+	disabled := DurationSampling{MinDurationStatement: -1, MinDurationSample: -1, StatementSampleRate: 0.25}
+	assert.Equal(t, 1.0, disabled.SampleRate(5*time.Second))
+}
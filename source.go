@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// SourceConfig describes one postgres log to read, like the flags do when
+// there is no config file.
+type SourceConfig struct {
+	// Stamped onto every message from this source as "source" and "cluster".
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+
+	LoggerSourceType string          `json:"logger_source_type"`
+	InputFormat      string          `json:"input_format"`
+	LogLinePrefix    string          `json:"log_line_prefix"`
+	FilePath         string          `json:"file_path"`
+	FileStatePath    string          `json:"file_state_path"`
+	Journald         JournaldOptions `json:"journald"`
+	Syslog           SyslogOptions   `json:"syslog"`
+}
+
+func DefaultSourceConfig() SourceConfig {
+	return SourceConfig{
+		LoggerSourceType: "stdin",
+		InputFormat:      "stderr",
+		LogLinePrefix:    DefaultLogLinePrefix,
+		Journald:         DefaultJournaldOptions(),
+		Syslog:           DefaultSyslogOptions(),
+	}
+}
+
+// LoadSourceConfigs reads the sources from a config file like:
+//
+//	{"sources": [
+//	  {"name": "main", "cluster": "ledger", "logger_source_type": "file", "file_path": "/var/log/postgresql/main/*.log"},
+//	  {"name": "replica", "cluster": "ledger", "logger_source_type": "journald", "journald": {"units": ["postgresql@14-replica"]}}
+//	]}
+//
+// Settings a source leaves out have the same defaults as the flags.
+func LoadSourceConfigs(path string) ([]SourceConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Sources []json.RawMessage `json:"sources"`
+	}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Sources) == 0 {
+		return nil, errors.New("the config has no sources")
+	}
+
+	names := make(map[string]bool)
+	sources := []SourceConfig{}
+	for _, raw := range config.Sources {
+		source := DefaultSourceConfig()
+		err = json.Unmarshal(raw, &source)
+		if err != nil {
+			return nil, err
+		}
+		if source.Name == "" {
+			return nil, errors.New("every source needs a name")
+		}
+		if names[source.Name] {
+			return nil, fmt.Errorf("there is more than one source named %q", source.Name)
+		}
+		names[source.Name] = true
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// A checkpointer is a logger source that can resume where it stopped. It is
+// told which entries have been sent, so that entries it read but that were
+// still being parsed are read again after a restart instead of skipped.
+type checkpointer interface {
+	Processed(cursor string)
+	SaveState()
+}
+
+// Source is a logger source and the parser for its log format.
+type Source struct {
+	config     SourceConfig
+	parser     LogParser
+	checkpoint checkpointer
+	closer     interface{ Close() }
+}
+
+func OpenSource(config SourceConfig) (*Source, error) {
+	prefix, err := NewLogLinePrefix(config.LogLinePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log line prefix: %v", err)
+	}
+
+	source := &Source{config: config}
+	var logScanner LogScanner
+
+	switch config.LoggerSourceType {
+	case "journald":
+		journaldScanner, err := NewJournaldLogScanner(config.Journald)
+		if err != nil {
+			return nil, fmt.Errorf("could not start the journald logger source: %v", err)
+		}
+		logScanner = journaldScanner
+		source.checkpoint = journaldScanner
+		source.closer = journaldScanner
+	case "stdin":
+		logScanner = NewStdinLogScanner()
+	case "file":
+		fileScanner, err := NewFileLogScanner(config.FilePath, config.FileStatePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not start the file logger source: %v", err)
+		}
+		logScanner = fileScanner
+		source.checkpoint = fileScanner
+		source.closer = fileScanner
+	case "container":
+		fileScanner, err := NewFileLogScanner(config.FilePath, config.FileStatePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not start the container logger source: %v", err)
+		}
+		logScanner = NewContainerLogScanner(fileScanner)
+		source.checkpoint = fileScanner
+		source.closer = fileScanner
+	case "syslog":
+		syslogScanner, err := NewSyslogLogScanner(config.Syslog)
+		if err != nil {
+			return nil, fmt.Errorf("could not start the syslog logger source: %v", err)
+		}
+		logScanner = syslogScanner
+		source.closer = syslogScanner
+	default:
+		return nil, fmt.Errorf("unknown logger source type: %s", config.LoggerSourceType)
+	}
+
+	switch config.InputFormat {
+	case "stderr":
+		if fileScanner, ok := logScanner.(*FileLogScanner); ok {
+			fileScanner.startsEntry = prefix.StartsEntry
+		}
+		source.parser = NewPostgresLogParserWithPrefix(logScanner, prefix)
+	case "csv":
+		source.parser = NewCSVLogParser(NewLogScannerReader(logScanner))
+	case "json":
+		source.parser = NewJSONLogParser(logScanner)
+	default:
+		source.Close()
+		return nil, fmt.Errorf("unknown input format: %s", config.InputFormat)
+	}
+
+	return source, nil
+}
+
+// Close stops the logger source, which makes Run return once what was already
+// read has been sent. Sources that read stdin stop at its end instead.
+func (self *Source) Close() {
+	if self.closer != nil {
+		self.closer.Close()
+	}
+}
+
+// Run sends a message for every entry of the source to sink until the
+// source ends.
+func (self *Source) Run(sink Sink) {
+	if self.checkpoint != nil {
+		defer self.checkpoint.SaveState()
+	}
+
+	for {
+		pgLogLine, err := self.parser.Parse()
+		if err == ErrLogEOF {
+			return
+		}
+		if err == ErrInvalidLogLine {
+			fmt.Println("Skipping log line:", err)
+			continue
+		}
+		if err != nil {
+			fmt.Println("Error parsing postgres log:", err)
+			continue
+		}
+
+		self.label(pgLogLine)
+		HandlePostgresLogLine(pgLogLine, sink)
+		if self.checkpoint != nil {
+			self.checkpoint.Processed(pgLogLine.Cursor)
+		}
+	}
+}
+
+// label stamps the name and cluster of the source onto the entry.
+func (self *Source) label(logLine *PostgresLogLine) {
+	if self.config.Name == "" && self.config.Cluster == "" {
+		return
+	}
+
+	metadata := new(SourceMetadata)
+	if logLine.Source != nil {
+		*metadata = *logLine.Source
+	}
+	metadata.Name = self.config.Name
+	metadata.Cluster = self.config.Cluster
+	logLine.Source = metadata
+}
+
+// RunSources runs every source in its own goroutine, all sending to the same
+// sink, until they have all ended.
+func RunSources(sources []*Source, sink Sink) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source *Source) {
+			defer wg.Done()
+			source.Run(sink)
+		}(source)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSourceConfig(t *testing.T, dir string, config string) string {
+	path := filepath.Join(dir, "timber.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(config), 0644))
+	return path
+}
+
+func TestLoadSourceConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeSourceConfig(t, dir, `{"sources": [
+		{"name": "main", "cluster": "ledger", "logger_source_type": "file", "file_path": "/var/log/postgresql/main/*.log"},
+		{"name": "replica", "cluster": "ledger", "logger_source_type": "journald", "journald": {"units": ["postgresql@14-replica"]}}
+	]}`)
+
+	sources, err := LoadSourceConfigs(path)
+	assert.Nil(t, err)
+	assert.Len(t, sources, 2)
+
+	assert.Equal(t, "main", sources[0].Name)
+	assert.Equal(t, "file", sources[0].LoggerSourceType)
+	assert.Equal(t, "/var/log/postgresql/main/*.log", sources[0].FilePath)
+	assert.Equal(t, "stderr", sources[0].InputFormat)
+	assert.Equal(t, DefaultLogLinePrefix, sources[0].LogLinePrefix)
+
+	// Journald settings that are left out keep their defaults.
+	assert.Equal(t, []string{"postgresql@14-replica"}, sources[1].Journald.Units)
+	assert.Equal(t, "postgres", sources[1].Journald.Identifier)
+	assert.Equal(t, "/bin/journalctl", sources[1].Journald.JournalctlPath)
+}
+
+func TestLoadSourceConfigs_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = LoadSourceConfigs(writeSourceConfig(t, dir, `{"sources": []}`))
+	assert.NotNil(t, err)
+
+	_, err = LoadSourceConfigs(writeSourceConfig(t, dir, `{"sources": [{"logger_source_type": "stdin"}]}`))
+	assert.NotNil(t, err)
+
+	_, err = LoadSourceConfigs(writeSourceConfig(t, dir, `{"sources": [{"name": "a"}, {"name": "a"}]}`))
+	assert.NotNil(t, err)
+
+	_, err = LoadSourceConfigs(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestOpenSource_Invalid(t *testing.T) {
+	config := DefaultSourceConfig()
+	config.LoggerSourceType = "carrier-pigeon"
+	_, err := OpenSource(config)
+	assert.NotNil(t, err)
+
+	config = DefaultSourceConfig()
+	config.InputFormat = "xml"
+	_, err = OpenSource(config)
+	assert.NotNil(t, err)
+}
+
+// lockedBuffer collects the messages sent by sources running concurrently.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.buffer.Write(p)
+	return self.buffer.WriteString("\n")
+}
+
+func TestRunSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"main", "replica"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+
+	sources := []*Source{}
+	for _, name := range []string{"main", "replica"} {
+		config := DefaultSourceConfig()
+		config.Name = name
+		config.Cluster = "ledger"
+		config.LoggerSourceType = "file"
+		config.FilePath = filepath.Join(dir, name, "*.log")
+
+		source, err := OpenSource(config)
+		assert.Nil(t, err)
+		sources = append(sources, source)
+	}
+
+	output := new(lockedBuffer)
+	done := make(chan struct{})
+	go func() {
+		RunSources(sources, NewWriterSink(output))
+		close(done)
+	}()
+
+	line := "2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  temporary file: path \"base/pgsql_tmp/pgsql_tmp56193.0\", size 1024\n"
+	for _, name := range []string{"main", "replica"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name, "postgresql.log"), []byte(line), 0644))
+	}
+
+	// Each parser sends its entry once it has been idle for a second.
+	time.Sleep(1500 * time.Millisecond)
+	for _, source := range sources {
+		source.Close()
+	}
+	<-done
+
+	output.mutex.Lock()
+	messages := strings.Split(strings.TrimSpace(output.buffer.String()), "\n")
+	output.mutex.Unlock()
+
+	assert.Len(t, messages, 2)
+	joined := strings.Join(messages, "\n")
+	assert.Contains(t, joined, `"source":"main","cluster":"ledger"`)
+	assert.Contains(t, joined, `"source":"replica","cluster":"ledger"`)
+}
+
+func TestSource_SavesOffsetsOfSentEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := DefaultSourceConfig()
+	config.LoggerSourceType = "file"
+	config.FilePath = filepath.Join(dir, "postgresql.log")
+	config.FileStatePath = filepath.Join(dir, "timber.state")
+	assert.Nil(t, ioutil.WriteFile(config.FilePath, nil, 0644))
+
+	source, err := OpenSource(config)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		source.Run(NewWriterSink(new(lockedBuffer)))
+		close(done)
+	}()
+
+	first := "2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger LOG:  temporary file: path \"base/pgsql_tmp/pgsql_tmp56193.0\", size 1024\n"
+	second := "2021-02-19 15:04:06 UTC [56193-3/9939-5707] app@ledger LOG:  temporary file: path \"base/pgsql_tmp/pgsql_tmp56193.1\", size 2048\n"
+	assert.Nil(t, ioutil.WriteFile(config.FilePath, []byte(first+second), 0644))
+
+	// The first entry is sent once the second one starts, while the second one
+	// waits in the parser for lines that could continue it. Only the first is
+	// saved, so a crash now would read the second one again.
+	var state []byte
+	for deadline := time.Now().Add(500 * time.Millisecond); len(state) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		state, _ = ioutil.ReadFile(config.FileStatePath)
+	}
+	assert.Contains(t, string(state), fmt.Sprintf(`"offset":%d`, len(first)))
+
+	// Once closed, the rest is sent and saved.
+	source.Close()
+	<-done
+	state, _ = ioutil.ReadFile(config.FileStatePath)
+	assert.Contains(t, string(state), fmt.Sprintf(`"offset":%d`, len(first)+len(second)))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The columns are read in this order. total_exec_time is the name since
+// postgres 13.
+const statementStatsQuery = `SELECT s.queryid, d.datname, r.rolname, s.calls, s.total_exec_time, s.rows, s.shared_blks_hit, s.shared_blks_read, s.query
+FROM pg_stat_statements s
+JOIN pg_database d ON d.oid = s.dbid
+JOIN pg_roles r ON r.oid = s.userid
+WHERE s.queryid IS NOT NULL`
+
+type StatementStatsOptions struct {
+	PsqlPath string
+	// The connection string or URI psql connects with, ie: "host=/var/run/postgresql dbname=postgres".
+	ConnectionString string
+	// How often to snapshot pg_stat_statements, 0 to not poll it.
+	Interval time.Duration
+}
+
+func DefaultStatementStatsOptions() StatementStatsOptions {
+	return StatementStatsOptions{
+		PsqlPath: "psql",
+	}
+}
+
+type statementStatsKey struct {
+	queryID  string
+	database string
+	username string
+}
+
+// statementStats are the counters of one statement, which pg_stat_statements
+// keeps adding to.
+type statementStats struct {
+	query          string
+	calls          int64
+	totalExecTime  float64
+	rows           int64
+	sharedBlksHit  int64
+	sharedBlksRead int64
+}
+
+type StatementStatsMessage struct {
+	QueryID                     string  `json:"query_id"`
+	Query                       string  `json:"query"`
+	Database                    string  `json:"database"`
+	Username                    string  `json:"username"`
+	ShardName                   string  `json:"shard_name"`
+	ShardlessQuery              string  `json:"shardless_query"`
+	Calls                       int64   `json:"calls"`
+	TotalExecTimeInMilliseconds float64 `json:"total_exec_time_in_milliseconds"`
+	MeanExecTimeInMilliseconds  float64 `json:"mean_exec_time_in_milliseconds"`
+	Rows                        int64   `json:"rows"`
+	SharedBlksHit               int64   `json:"shared_blks_hit"`
+	SharedBlksRead              int64   `json:"shared_blks_read"`
+	IntervalInSeconds           float64 `json:"interval_in_seconds"`
+	CreatedAt                   string  `json:"created_at"`
+	Type                        string  `json:"type"`
+	HostName                    string  `json:"hostname"`
+	TimberVersion               string  `json:"timber_version"`
+}
+
+// StatementStatsPoller snapshots pg_stat_statements with psql and reports what
+// every statement did since the previous snapshot, including the statements
+// too fast to reach log_min_duration_statement.
+type StatementStatsPoller struct {
+	options  StatementStatsOptions
+	previous map[statementStatsKey]statementStats
+	polledAt time.Time
+}
+
+func NewStatementStatsPoller(options StatementStatsOptions) (*StatementStatsPoller, error) {
+	if options.ConnectionString == "" {
+		return nil, errors.New("a connection string is required to poll pg_stat_statements")
+	}
+	if options.PsqlPath == "" {
+		options.PsqlPath = DefaultStatementStatsOptions().PsqlPath
+	}
+	err := checkPsqlVersion(options.PsqlPath)
+	if err != nil {
+		return nil, err
+	}
+	return &StatementStatsPoller{options: options}, nil
+}
+
+// ie: "psql (PostgreSQL) 14.5 (Ubuntu 14.5-1.pgdg20.04+1)"
+var RegexPsqlVersion = regexp.MustCompile(`\(PostgreSQL\) (\d+)`)
+
+// psql prints --csv since version 12.
+const minPsqlVersion = 12
+
+// checkPsqlVersion makes sure psql can be run and is new enough, so that a
+// missing or old psql stops timber at startup instead of failing every poll.
+func checkPsqlVersion(psqlPath string) error {
+	output, err := exec.Command(psqlPath, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("could not run %s --version: %v", psqlPath, err)
+	}
+
+	match := RegexPsqlVersion.FindSubmatch(output)
+	if match == nil {
+		return fmt.Errorf("could not tell the version of %s from %q", psqlPath, bytes.TrimSpace(output))
+	}
+	version, _ := strconv.Atoi(string(match[1]))
+	if version < minPsqlVersion {
+		return fmt.Errorf("%s is version %d, polling pg_stat_statements needs psql %d or newer", psqlPath, version, minPsqlVersion)
+	}
+	return nil
+}
+
+// Poll takes a snapshot and returns a message for every statement that was
+// called since the last one. The first snapshot only sets the baseline.
+func (self *StatementStatsPoller) Poll() ([]*StatementStatsMessage, error) {
+	snapshot, err := self.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	var msgs []*StatementStatsMessage
+	if self.previous != nil {
+		msgs = statementStatsDeltas(self.previous, snapshot, now.Sub(self.polledAt))
+	}
+	self.previous = snapshot
+	self.polledAt = now
+	return msgs, nil
+}
+
+// Start sends the statement stats to sink once every interval.
+func (self *StatementStatsPoller) Start(sink Sink) {
+	go func() {
+		ticker := time.NewTicker(self.options.Interval)
+		for {
+			msgs, err := self.Poll()
+			if err != nil {
+				log.Println("Could not poll pg_stat_statements:", err)
+			}
+			for _, msg := range msgs {
+				SendMessage(msg, sink)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func (self *StatementStatsPoller) snapshot() (map[statementStatsKey]statementStats, error) {
+	var stdout bytes.Buffer
+	c := exec.Command(self.options.PsqlPath, "-X", "-q", "--csv", "-t", "-d", self.options.ConnectionString, "-c", statementStatsQuery)
+	c.Stdout = &stdout
+	c.Stderr = os.Stderr
+	err := c.Run()
+	if err != nil {
+		return nil, fmt.Errorf("psql failed: %v", err)
+	}
+	return parseStatementStats(&stdout)
+}
+
+// parseStatementStats reads the rows of statementStatsQuery as psql prints
+// them with --csv.
+func parseStatementStats(reader io.Reader) (map[statementStatsKey]statementStats, error) {
+	rows := csv.NewReader(reader)
+	rows.FieldsPerRecord = 9
+
+	snapshot := make(map[statementStatsKey]statementStats)
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return snapshot, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key := statementStatsKey{queryID: row[0], database: row[1], username: row[2]}
+		stats := statementStats{query: row[8]}
+		stats.calls, _ = strconv.ParseInt(row[3], 10, 64)
+		stats.totalExecTime, _ = strconv.ParseFloat(row[4], 64)
+		stats.rows, _ = strconv.ParseInt(row[5], 10, 64)
+		stats.sharedBlksHit, _ = strconv.ParseInt(row[6], 10, 64)
+		stats.sharedBlksRead, _ = strconv.ParseInt(row[7], 10, 64)
+
+		// Postgres 14 keeps top level and nested calls of a statement apart.
+		if existing, ok := snapshot[key]; ok {
+			stats.calls += existing.calls
+			stats.totalExecTime += existing.totalExecTime
+			stats.rows += existing.rows
+			stats.sharedBlksHit += existing.sharedBlksHit
+			stats.sharedBlksRead += existing.sharedBlksRead
+		}
+		snapshot[key] = stats
+	}
+}
+
+// statementStatsDeltas returns what every statement did between two snapshots.
+// A statement with fewer calls than before was reset or evicted in between,
+// so everything it counts is new.
+func statementStatsDeltas(previous map[statementStatsKey]statementStats, current map[statementStatsKey]statementStats, interval time.Duration) []*StatementStatsMessage {
+	msgs := []*StatementStatsMessage{}
+	for key, stats := range current {
+		delta := stats
+		if before, ok := previous[key]; ok && before.calls <= stats.calls {
+			delta.calls -= before.calls
+			delta.totalExecTime -= before.totalExecTime
+			delta.rows -= before.rows
+			delta.sharedBlksHit -= before.sharedBlksHit
+			delta.sharedBlksRead -= before.sharedBlksRead
+		}
+		if delta.calls == 0 {
+			continue
+		}
+
+		shardName, shardlessQuery := DerivedValues(stats.query)
+		msgs = append(msgs, &StatementStatsMessage{
+			QueryID:                     key.queryID,
+			Query:                       ScrubQuery(stats.query),
+			Database:                    key.database,
+			Username:                    key.username,
+			ShardName:                   shardName,
+			ShardlessQuery:              ScrubQuery(shardlessQuery),
+			Calls:                       delta.calls,
+			TotalExecTimeInMilliseconds: delta.totalExecTime,
+			MeanExecTimeInMilliseconds:  delta.totalExecTime / float64(delta.calls),
+			Rows:                        delta.rows,
+			SharedBlksHit:               delta.sharedBlksHit,
+			SharedBlksRead:              delta.sharedBlksRead,
+			IntervalInSeconds:           interval.Seconds(),
+			CreatedAt:                   time.Now().UTC().String(),
+			Type:                        "timber.postgres_statement_stats",
+			HostName:                    HostName(),
+			TimberVersion:               TimberVersion(),
+		})
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Database != msgs[j].Database {
+			return msgs[i].Database < msgs[j].Database
+		}
+		if msgs[i].Username != msgs[j].Username {
+			return msgs[i].Username < msgs[j].Username
+		}
+		return msgs[i].QueryID < msgs[j].QueryID
+	})
+	return msgs
+}
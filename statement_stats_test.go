@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatementStats(t *testing.T) {
+	rows := `101,ledger,app,10,25.5,10,100,5,"SELECT * FROM ""shard_1"".accounts WHERE name = $1"
+101,ledger,app,2,4.5,2,20,1,"SELECT * FROM ""shard_1"".accounts WHERE name = $1"
+102,ledger,admin,1,1000,0,0,0,"VACUUM
+  accounts"
+`
+
+	snapshot, err := parseStatementStats(strings.NewReader(rows))
+	assert.Nil(t, err)
+	assert.Len(t, snapshot, 2)
+
+	// Top level and nested calls of the same statement are added together.
+	assert.Equal(t, statementStats{
+		query:          `SELECT * FROM "shard_1".accounts WHERE name = $1`,
+		calls:          12,
+		totalExecTime:  30,
+		rows:           12,
+		sharedBlksHit:  120,
+		sharedBlksRead: 6,
+	}, snapshot[statementStatsKey{queryID: "101", database: "ledger", username: "app"}])
+	assert.Equal(t, "VACUUM\n  accounts", snapshot[statementStatsKey{queryID: "102", database: "ledger", username: "admin"}].query)
+}
+
+func TestStatementStatsDeltas(t *testing.T) {
+	selectKey := statementStatsKey{queryID: "101", database: "ledger", username: "app"}
+	updateKey := statementStatsKey{queryID: "102", database: "ledger", username: "app"}
+	resetKey := statementStatsKey{queryID: "103", database: "ledger", username: "app"}
+
+	previous := map[statementStatsKey]statementStats{
+		selectKey: {query: `SELECT * FROM "shard_1".accounts WHERE name = 'bob'`, calls: 10, totalExecTime: 20, rows: 10, sharedBlksHit: 100, sharedBlksRead: 5},
+		updateKey: {query: "UPDATE accounts SET name = $1", calls: 3, totalExecTime: 3},
+		resetKey:  {query: "DELETE FROM accounts", calls: 50, totalExecTime: 500},
+	}
+	current := map[statementStatsKey]statementStats{
+		selectKey: {query: `SELECT * FROM "shard_1".accounts WHERE name = 'bob'`, calls: 14, totalExecTime: 30, rows: 16, sharedBlksHit: 140, sharedBlksRead: 7},
+		updateKey: {query: "UPDATE accounts SET name = $1", calls: 3, totalExecTime: 3},
+		resetKey:  {query: "DELETE FROM accounts", calls: 2, totalExecTime: 8},
+	}
+
+	msgs := statementStatsDeltas(previous, current, time.Minute)
+	assert.Len(t, msgs, 2)
+
+	assert.Equal(t, "101", msgs[0].QueryID)
+	assert.Equal(t, `SELECT * FROM "shard_1".accounts WHERE name = 'xxx'`, msgs[0].Query)
+	assert.Equal(t, "shard_1", msgs[0].ShardName)
+	assert.Equal(t, "SELECT * FROM accounts WHERE name = 'xxx'", msgs[0].ShardlessQuery)
+	assert.Equal(t, int64(4), msgs[0].Calls)
+	assert.Equal(t, 10.0, msgs[0].TotalExecTimeInMilliseconds)
+	assert.Equal(t, 2.5, msgs[0].MeanExecTimeInMilliseconds)
+	assert.Equal(t, int64(6), msgs[0].Rows)
+	assert.Equal(t, int64(40), msgs[0].SharedBlksHit)
+	assert.Equal(t, int64(2), msgs[0].SharedBlksRead)
+	assert.Equal(t, 60.0, msgs[0].IntervalInSeconds)
+	assert.Equal(t, "timber.postgres_statement_stats", msgs[0].Type)
+
+	// A statement that was reset counts from zero.
+	assert.Equal(t, "103", msgs[1].QueryID)
+	assert.Equal(t, int64(2), msgs[1].Calls)
+	assert.Equal(t, 8.0, msgs[1].TotalExecTimeInMilliseconds)
+}
+
+func TestStatementStatsPoller_Poll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A stand-in for psql that counts one more call every time it runs.
+	countPath := filepath.Join(dir, "count")
+	psqlPath := filepath.Join(dir, "psql")
+	script := "#!/bin/sh\nif [ \"$1\" = --version ]; then echo 'psql (PostgreSQL) 14.5'; exit; fi\ncount=$(cat " + countPath + " 2>/dev/null || echo 0)\ncount=$((count + 1))\necho $count > " + countPath + "\necho \"101,ledger,app,$count,$count,$count,0,0,SELECT 1\"\n"
+	assert.Nil(t, ioutil.WriteFile(psqlPath, []byte(script), 0755))
+
+	_, err = NewStatementStatsPoller(StatementStatsOptions{PsqlPath: psqlPath})
+	assert.NotNil(t, err)
+
+	poller, err := NewStatementStatsPoller(StatementStatsOptions{PsqlPath: psqlPath, ConnectionString: "dbname=postgres"})
+	assert.Nil(t, err)
+
+	msgs, err := poller.Poll()
+	assert.Nil(t, err)
+	assert.Empty(t, msgs)
+
+	msgs, err = poller.Poll()
+	assert.Nil(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(1), msgs[0].Calls)
+	assert.Equal(t, "ledger", msgs[0].Database)
+	assert.Equal(t, "app", msgs[0].Username)
+
+	poller.options.PsqlPath = filepath.Join(dir, "missing")
+	_, err = poller.Poll()
+	assert.NotNil(t, err)
+}
+
+func TestNewStatementStatsPoller_ChecksPsql(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := StatementStatsOptions{ConnectionString: "dbname=postgres"}
+
+	options.PsqlPath = filepath.Join(dir, "missing")
+	_, err = NewStatementStatsPoller(options)
+	assert.Contains(t, err.Error(), "could not run")
+
+	// psql 11 can't print --csv.
+	options.PsqlPath = filepath.Join(dir, "psql")
+	assert.Nil(t, ioutil.WriteFile(options.PsqlPath, []byte("#!/bin/sh\necho 'psql (PostgreSQL) 11.14'\n"), 0755))
+	_, err = NewStatementStatsPoller(options)
+	assert.Contains(t, err.Error(), "is version 11")
+
+	assert.Nil(t, ioutil.WriteFile(options.PsqlPath, []byte("#!/bin/sh\necho 'psql (PostgreSQL) 16devel'\n"), 0755))
+	_, err = NewStatementStatsPoller(options)
+	assert.Nil(t, err)
+}
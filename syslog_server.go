@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ie: "<134>1 2021-02-19T15:04:05.123Z db1 postgres 56193 - - message". The
+	// message can span lines when postgres does not split it.
+	RegexSyslog5424 = regexp.MustCompile(`^<(\d{1,3})>1 (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[(?:[^\]\\]|\\.)*\])+)(?: ((?s:.*)))?$`)
+	// ie: "<134>Feb 19 15:04:05 db1 postgres[56193]: message"
+	RegexSyslog3164 = regexp.MustCompile(`^<(\d{1,3})>([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (?:(\S+) )?([^\s\[:]+)(?:\[(\d+)\])?: ?((?s:.*))$`)
+	// Postgres numbers the chunks of a message when syslog_sequence_numbers and
+	// syslog_split_messages are on, ie: "[12-2] " is the second chunk of message 12.
+	RegexSyslogChunk = regexp.MustCompile(`^\[(\d+)(?:-(\d+))?\] `)
+
+	ErrInvalidSyslogMessage = errors.New("Invalid syslog message")
+)
+
+// Postgres splits syslog messages into chunks of at most this many bytes, or
+// a few less so that a multibyte character is not split.
+const (
+	syslogChunkLimit    = 900
+	syslogChunkBackoff  = 3
+	maxSyslogFrameBytes = 64 * 1024
+)
+
+type SyslogMessage struct {
+	Priority  int
+	Timestamp string
+	HostName  string
+	AppName   string
+	ProcID    string
+	Message   string
+}
+
+// ParseSyslogMessage parses an RFC 5424 or RFC 3164 message.
+func ParseSyslogMessage(data string) (*SyslogMessage, error) {
+	data = strings.TrimRight(data, "\r\n\x00")
+
+	if match := RegexSyslog5424.FindStringSubmatch(data); match != nil {
+		msg := &SyslogMessage{
+			Timestamp: match[2],
+			HostName:  nilValue(match[3]),
+			AppName:   nilValue(match[4]),
+			ProcID:    nilValue(match[5]),
+			Message:   strings.TrimPrefix(match[8], "\xEF\xBB\xBF"),
+		}
+		msg.Priority, _ = strconv.Atoi(match[1])
+		return msg, nil
+	}
+
+	if match := RegexSyslog3164.FindStringSubmatch(data); match != nil {
+		msg := &SyslogMessage{
+			Timestamp: match[2],
+			HostName:  match[3],
+			AppName:   match[4],
+			ProcID:    match[5],
+			Message:   match[6],
+		}
+		msg.Priority, _ = strconv.Atoi(match[1])
+		return msg, nil
+	}
+
+	return nil, ErrInvalidSyslogMessage
+}
+
+// RFC 5424 writes "-" for a field it has no value for.
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+type SyslogOptions struct {
+	// The addresses to listen on, ie: ":514". Either can be empty.
+	UDPAddr string `json:"udp_addr"`
+	TCPAddr string `json:"tcp_addr"`
+	// Only messages from this app name or tag are read, all of them when empty.
+	Identifier string `json:"identifier"`
+	// How long to wait for the rest of a message that postgres split into chunks.
+	FlushInterval time.Duration `json:"-"`
+}
+
+func DefaultSyslogOptions() SyslogOptions {
+	return SyslogOptions{
+		Identifier:    "postgres",
+		FlushInterval: time.Second,
+	}
+}
+
+// SyslogLogScanner receives postgres logs from syslog over UDP and TCP, from any
+// number of hosts. The chunks postgres splits messages into are put back
+// together, and the lines of each entry are returned one after the other so
+// that entries from different hosts and processes are not interleaved.
+type SyslogLogScanner struct {
+	options     SyslogOptions
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+
+	messages    chan *SyslogMessage
+	pending     map[string]*syslogEntry
+	ready       []*LogRecord
+	record      *LogRecord
+	flushTicker *time.Ticker
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// syslogEntry is a message postgres split into chunks, for one host and pid.
+type syslogEntry struct {
+	sequence  string
+	hostName  string
+	lines     []string
+	lastChunk string
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+func NewSyslogLogScanner(options SyslogOptions) (*SyslogLogScanner, error) {
+	if options.UDPAddr == "" && options.TCPAddr == "" {
+		return nil, errors.New("a UDP or TCP syslog address is required")
+	}
+
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultSyslogOptions().FlushInterval
+	}
+
+	scanner := &SyslogLogScanner{
+		options:     options,
+		messages:    make(chan *SyslogMessage, 1000),
+		pending:     make(map[string]*syslogEntry),
+		flushTicker: time.NewTicker(options.FlushInterval / 2),
+		closed:      make(chan struct{}),
+	}
+
+	if options.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", options.UDPAddr)
+		if err != nil {
+			return nil, err
+		}
+		scanner.udpConn = conn
+		go scanner.receiveUDP()
+	}
+
+	if options.TCPAddr != "" {
+		listener, err := net.Listen("tcp", options.TCPAddr)
+		if err != nil {
+			scanner.Close()
+			return nil, err
+		}
+		scanner.tcpListener = listener
+		go scanner.acceptTCP()
+	}
+
+	return scanner, nil
+}
+
+func (self *SyslogLogScanner) Scan() bool {
+	for len(self.ready) == 0 {
+		select {
+		case msg := <-self.messages:
+			self.add(msg)
+		case <-self.flushTicker.C:
+			self.flush(time.Now().Add(-self.options.FlushInterval))
+		case <-self.closed:
+			self.drain()
+			if len(self.ready) == 0 {
+				return false
+			}
+		}
+	}
+
+	self.record = self.ready[0]
+	self.ready = self.ready[1:]
+	return true
+}
+
+// drain completes every entry with the messages that were already received.
+func (self *SyslogLogScanner) drain() {
+	for {
+		select {
+		case msg := <-self.messages:
+			self.add(msg)
+		default:
+			self.flush(time.Now())
+			return
+		}
+	}
+}
+
+func (self *SyslogLogScanner) Text() string {
+	return self.record.Text
+}
+
+func (self *SyslogLogScanner) Record() *LogRecord {
+	return self.record
+}
+
+func (self *SyslogLogScanner) Err() error {
+	return nil
+}
+
+// Close stops listening and makes Scan return false once the messages that
+// were received have been returned. It is safe to call from another goroutine.
+func (self *SyslogLogScanner) Close() {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		self.flushTicker.Stop()
+		if self.udpConn != nil {
+			self.udpConn.Close()
+		}
+		if self.tcpListener != nil {
+			self.tcpListener.Close()
+		}
+	})
+}
+
+func (self *SyslogLogScanner) receive(data string) {
+	msg, err := ParseSyslogMessage(data)
+	if err != nil {
+		log.Println("Skipping syslog message:", err)
+		return
+	}
+	if self.options.Identifier != "" && msg.AppName != self.options.Identifier {
+		return
+	}
+
+	select {
+	case self.messages <- msg:
+	case <-self.closed:
+	}
+}
+
+func (self *SyslogLogScanner) receiveUDP() {
+	buffer := make([]byte, maxSyslogFrameBytes)
+	for {
+		n, _, err := self.udpConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		self.receive(string(buffer[:n]))
+	}
+}
+
+func (self *SyslogLogScanner) acceptTCP() {
+	for {
+		conn, err := self.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		go self.receiveTCP(conn)
+	}
+}
+
+func (self *SyslogLogScanner) receiveTCP(conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-self.closed
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readSyslogFrame(reader)
+		if err != nil {
+			select {
+			case <-self.closed:
+			default:
+				if err != io.EOF {
+					log.Println("Error reading syslog connection:", err)
+				}
+			}
+			return
+		}
+		self.receive(frame)
+	}
+}
+
+// readSyslogFrame reads a message with octet counting, "LENGTH MESSAGE", or one
+// terminated by a newline as older senders do. Newlines between frames are
+// skipped.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	for err == nil && (first[0] == '\n' || first[0] == '\r') {
+		reader.ReadByte()
+		first, err = reader.Peek(1)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			return line, nil
+		}
+		return line, err
+	}
+
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || n > maxSyslogFrameBytes {
+		return "", errors.New("invalid syslog frame length: " + length)
+	}
+
+	frame := make([]byte, n)
+	_, err = io.ReadFull(reader, frame)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return string(frame), err
+}
+
+// add puts a chunk into the entry it belongs to. A chunk of a new message from
+// the same process means the previous message is complete.
+func (self *SyslogLogScanner) add(msg *SyslogMessage) {
+	key := msg.HostName + "/" + msg.ProcID
+	body, sequence, chunk := msg.Message, "", ""
+	if match := RegexSyslogChunk.FindStringSubmatch(msg.Message); match != nil {
+		body, sequence, chunk = msg.Message[len(match[0]):], match[1], match[2]
+	}
+
+	entry, ok := self.pending[key]
+	if ok && (chunk == "" || sequence != entry.sequence) {
+		self.ready = append(self.ready, entry.records()...)
+		delete(self.pending, key)
+	}
+
+	if chunk == "" {
+		// The message was not split.
+		entry = &syslogEntry{hostName: msg.HostName}
+		for _, line := range strings.Split(body, "\n") {
+			entry.lines = append(entry.lines, strings.TrimRight(line, "\r"))
+		}
+		self.ready = append(self.ready, entry.records()...)
+		return
+	}
+
+	now := time.Now()
+	entry, ok = self.pending[key]
+	if !ok {
+		entry = &syslogEntry{sequence: sequence, hostName: msg.HostName, firstSeen: now}
+		self.pending[key] = entry
+	}
+	entry.lastSeen = now
+	entry.addChunk(body)
+}
+
+// addChunk starts a new line, unless the last chunk was cut short of a newline
+// because it reached the chunk limit.
+func (self *syslogEntry) addChunk(chunk string) {
+	if len(self.lines) > 0 && len(self.lastChunk) >= syslogChunkLimit-syslogChunkBackoff {
+		self.lines[len(self.lines)-1] += chunk
+	} else {
+		self.lines = append(self.lines, chunk)
+	}
+	self.lastChunk = chunk
+}
+
+func (self *syslogEntry) records() []*LogRecord {
+	records := make([]*LogRecord, 0, len(self.lines))
+	for _, line := range self.lines {
+		records = append(records, &LogRecord{
+			Text:   line,
+			Source: &SourceMetadata{HostName: self.hostName},
+		})
+	}
+	return records
+}
+
+// flush completes the entries that have not received a chunk since before.
+func (self *SyslogLogScanner) flush(before time.Time) {
+	stale := []string{}
+	for key, entry := range self.pending {
+		if !entry.lastSeen.After(before) {
+			stale = append(stale, key)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return self.pending[stale[i]].firstSeen.Before(self.pending[stale[j]].firstSeen)
+	})
+
+	for _, key := range stale {
+		self.ready = append(self.ready, self.pending[key].records()...)
+		delete(self.pending, key)
+	}
+}
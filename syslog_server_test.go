@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslogMessage_RFC5424(t *testing.T) {
+	msg, err := ParseSyslogMessage("<134>1 2021-02-19T15:04:05.123Z db1 postgres 56193 - [meta sequenceId=\"1\"] \xEF\xBB\xBF[3-1] LOG:  hello\n")
+	assert.Nil(t, err)
+	assert.Equal(t, &SyslogMessage{
+		Priority:  134,
+		Timestamp: "2021-02-19T15:04:05.123Z",
+		HostName:  "db1",
+		AppName:   "postgres",
+		ProcID:    "56193",
+		Message:   "[3-1] LOG:  hello",
+	}, msg)
+
+	// Postgres sends a multi-line message in one frame when it does not split
+	// messages.
+	msg, err = ParseSyslogMessage("<134>1 2021-02-19T15:04:05.123Z db1 postgres 56193 - - LOG:  statement: SELECT\n\t1\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "LOG:  statement: SELECT\n\t1", msg.Message)
+
+	msg, err = ParseSyslogMessage("<134>1 - - postgres - - -")
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg.HostName)
+	assert.Equal(t, "", msg.Message)
+}
+
+func TestParseSyslogMessage_RFC3164(t *testing.T) {
+	msg, err := ParseSyslogMessage("<134>Feb  9 15:04:05 db1 postgres[56193]: [3-1] LOG:  hello")
+	assert.Nil(t, err)
+	assert.Equal(t, &SyslogMessage{
+		Priority:  134,
+		Timestamp: "Feb  9 15:04:05",
+		HostName:  "db1",
+		AppName:   "postgres",
+		ProcID:    "56193",
+		Message:   "[3-1] LOG:  hello",
+	}, msg)
+
+	msg, err = ParseSyslogMessage("<134>Feb 19 15:04:05 db1 postgres[56193]: LOG:  statement: SELECT\n\t1")
+	assert.Nil(t, err)
+	assert.Equal(t, "LOG:  statement: SELECT\n\t1", msg.Message)
+
+	// Local senders leave out the host name.
+	msg, err = ParseSyslogMessage("<134>Feb 19 15:04:05 postgres[56193]: [3-1] LOG:  hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "", msg.HostName)
+	assert.Equal(t, "postgres", msg.AppName)
+	assert.Equal(t, "[3-1] LOG:  hello", msg.Message)
+
+	_, err = ParseSyslogMessage("LOG:  hello")
+	assert.Equal(t, ErrInvalidSyslogMessage, err)
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("10 <134>1 a\nb17 <134>Feb 19 15:04\n<134>1 - - - - - - c\n<134>1 - - - - - - d"))
+
+	frame, err := readSyslogFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "<134>1 a\nb", frame)
+
+	frame, err = readSyslogFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "<134>Feb 19 15:04", frame)
+
+	frame, err = readSyslogFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "<134>1 - - - - - - c\n", frame)
+
+	frame, err = readSyslogFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "<134>1 - - - - - - d", frame)
+
+	_, err = readSyslogFrame(reader)
+	assert.NotNil(t, err)
+}
+
+func TestSyslogLogScanner_RebuildsChunks(t *testing.T) {
+	scanner := &SyslogLogScanner{pending: make(map[string]*syslogEntry)}
+	long := strings.Repeat("x", syslogChunkLimit)
+
+	scanner.add(&SyslogMessage{HostName: "db1", ProcID: "1", Message: "[3-1] LOG:  statement: SELECT 1"})
+	scanner.add(&SyslogMessage{HostName: "db2", ProcID: "1", Message: "[8-1] LOG:  statement: SELECT " + long})
+	scanner.add(&SyslogMessage{HostName: "db1", ProcID: "1", Message: "[3-2] \tFROM accounts"})
+	scanner.add(&SyslogMessage{HostName: "db2", ProcID: "1", Message: "[8-2] 2"})
+	assert.Equal(t, 0, len(scanner.ready))
+
+	// A new message from db1 completes the previous one.
+	scanner.add(&SyslogMessage{HostName: "db1", ProcID: "1", Message: "[4] LOG:  checkpoint starting: time"})
+	scanner.flush(time.Now())
+
+	texts := []string{}
+	for _, record := range scanner.ready {
+		texts = append(texts, record.Source.HostName+": "+record.Text)
+	}
+	assert.Equal(t, []string{
+		"db1: LOG:  statement: SELECT 1",
+		"db1: \tFROM accounts",
+		"db1: LOG:  checkpoint starting: time",
+		"db2: LOG:  statement: SELECT " + long + "2",
+	}, texts)
+}
+
+func TestSyslogLogScanner_UDPAndTCP(t *testing.T) {
+	options := DefaultSyslogOptions()
+	options.UDPAddr = "127.0.0.1:0"
+	options.TCPAddr = "127.0.0.1:0"
+	options.FlushInterval = 50 * time.Millisecond
+
+	scanner, err := NewSyslogLogScanner(options)
+	assert.Nil(t, err)
+	defer scanner.Close()
+
+	udp, err := net.Dial("udp", scanner.udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", scanner.tcpListener.Addr().String())
+	assert.Nil(t, err)
+	defer tcp.Close()
+
+	prefix := "2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger "
+	fmt.Fprint(udp, "<134>Feb 19 15:04:05 db1 postgres[56193]: [3-1] "+prefix+"LOG:  duration: 1.000 ms  statement: SELECT *")
+	fmt.Fprint(udp, "<134>Feb 19 15:04:05 db1 postgres[56193]: [3-2] \tFROM accounts")
+	fmt.Fprint(udp, "<134>Feb 19 15:04:05 db1 cron[1]: not postgres")
+
+	tcpMessage := "<134>1 2021-02-19T15:04:06Z db2 postgres 777 - - [9-1] " + strings.Replace(prefix, "56193", "777", 1) + "LOG:  duration: 2.000 ms  statement: SELECT 2"
+	fmt.Fprintf(tcp, "%d %s", len(tcpMessage), tcpMessage)
+
+	parser := NewPostgresLogParser(scanner)
+	queries := map[string]*PostgresLogLine{}
+	for i := 0; i < 2; i++ {
+		logLine, err := parser.Parse()
+		assert.Nil(t, err)
+		queries[logLine.Source.HostName] = logLine
+	}
+
+	assert.Equal(t, "SELECT *\r\n\tFROM accounts", queries["db1"].Value)
+	assert.Equal(t, 56193, queries["db1"].PID)
+	assert.Equal(t, "SELECT 2", queries["db2"].Value)
+	assert.Equal(t, "db2", queries["db2"].HostName())
+}
+
+func TestSyslogLogScanner_UnsplitMultilineMessages(t *testing.T) {
+	options := DefaultSyslogOptions()
+	options.UDPAddr = "127.0.0.1:0"
+	options.TCPAddr = "127.0.0.1:0"
+
+	scanner, err := NewSyslogLogScanner(options)
+	assert.Nil(t, err)
+	defer scanner.Close()
+
+	udp, err := net.Dial("udp", scanner.udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", scanner.tcpListener.Addr().String())
+	assert.Nil(t, err)
+	defer tcp.Close()
+
+	// With syslog_split_messages off, the whole entry is in one frame.
+	prefix := "2021-02-19 15:04:05 UTC [56193-3/9939-5706] app@ledger "
+	fmt.Fprint(udp, "<134>Feb 19 15:04:05 db1 postgres[56193]: [3] "+prefix+"LOG:  duration: 1.000 ms  statement: SELECT *\n\tFROM accounts\n\tWHERE id = 1\n")
+
+	tcpMessage := "<134>1 2021-02-19T15:04:06Z db2 postgres 777 - - " + strings.Replace(prefix, "56193", "777", 1) + "LOG:  duration: 2.000 ms  statement: SELECT 2,\n\t3"
+	fmt.Fprintf(tcp, "%d %s", len(tcpMessage), tcpMessage)
+
+	parser := NewPostgresLogParser(scanner)
+	queries := map[string]*PostgresLogLine{}
+	for i := 0; i < 2; i++ {
+		logLine, err := parser.Parse()
+		assert.Nil(t, err)
+		queries[logLine.Source.HostName] = logLine
+	}
+
+	assert.Equal(t, "SELECT *\r\n\tFROM accounts\r\n\tWHERE id = 1", queries["db1"].Value)
+	assert.Equal(t, 1*time.Millisecond, queries["db1"].Duration)
+	assert.Equal(t, "SELECT 2,\r\n\t3", queries["db2"].Value)
+}
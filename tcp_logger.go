@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -14,11 +19,15 @@ import (
 // redeliver messages given connection.Write errors.
 type TCPLogger struct {
 	conn          net.Conn
+	dial          func() (net.Conn, error)
 	deadlineWait  time.Duration
 	retryLimit    int
 	retries       int
 	sleepDuration time.Duration
 
+	// When set, Write waits for room in the queue instead of dropping messages.
+	blocking bool
+
 	logLines chan []byte
 }
 
@@ -34,8 +43,71 @@ func NewTCPLogger(conn net.Conn, retryLimit int) TCPLogger {
 	}
 }
 
+// DialTCPLogger connects to url and starts a TCPLogger sending to it.
+func DialTCPLogger(url string) (*TCPLogger, error) {
+	return DialTCPLoggerWithTLS(url, nil)
+}
+
+// DialTCPLoggerWithTLS connects to url over TLS when tlsConfig is set, and
+// starts a TCPLogger sending to it. The handshake is done before returning so
+// a bad certificate is found at startup, and reconnects use TLS as well.
+func DialTCPLoggerWithTLS(url string, tlsConfig *tls.Config) (*TCPLogger, error) {
+	log.Println("Creating TCPLogger...")
+	dial := func() (net.Conn, error) {
+		if tlsConfig != nil {
+			return dialTLS(url, tlsConfig)
+		}
+		return net.Dial("tcp", url)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := NewTCPLogger(conn, 10)
+	logger.dial = dial
+	logger.Start()
+	return &logger, nil
+}
+
+// How long to wait for the server to reject the client certificate.
+const tlsClientCertificateWait = 500 * time.Millisecond
+
+// dialTLS connects over TLS and makes sure the server accepted the client
+// certificate. With TLS 1.3 the server only checks it after the handshake is
+// done on our side, and rejects it with an alert instead of failing the
+// handshake, so the connection is read until the alert shows up or the wait
+// is over.
+func dialTLS(url string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := tls.Dial("tcp", url, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(tlsConfig.Certificates) == 0 || conn.ConnectionState().Version != tls.VersionTLS13 {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(tlsClientCertificateWait))
+	_, err = conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return conn, nil
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("the server did not accept the client certificate: %v", err)
+	}
+	return conn, nil
+}
+
 // Write pushes bytes given into local chan to flush out to connection.
 func (t *TCPLogger) Write(p []byte) (n int, err error) {
+	if t.blocking {
+		t.logLines <- p
+		return len(p), nil
+	}
+
 	select {
 	case t.logLines <- p:
 		return len(p), nil
@@ -84,7 +156,13 @@ func (t *TCPLogger) handleConnError(err error, b []byte) {
 // RetryConnection will attempt to reestablish connection to net.Conn
 func (t *TCPLogger) RetryConnection() error {
 	log.Println("Attempting tcp connection reestablish...")
-	conn, err := net.Dial(t.conn.RemoteAddr().Network(), t.conn.RemoteAddr().String())
+	var conn net.Conn
+	var err error
+	if t.dial != nil {
+		conn, err = t.dial()
+	} else {
+		conn, err = net.Dial(t.conn.RemoteAddr().Network(), t.conn.RemoteAddr().String())
+	}
 	if err != nil {
 		log.Println("Error reconnecting:", err)
 		return err
@@ -125,3 +203,73 @@ func (t TCPLogger) Close() {
 func logstashDelimit(b []byte) []byte {
 	return append(b, []byte("\r\n")...)
 }
+
+// TLSOptions configures TLS for the TCP output.
+type TLSOptions struct {
+	// Turns TLS on with the system CAs. Setting any of the files or the server
+	// name turns it on as well.
+	Enabled bool
+	// A PEM bundle of the CAs to verify the server with, the system ones when empty.
+	CAPath string
+	// A PEM client certificate and key, for servers that require mutual auth.
+	CertPath string
+	KeyPath  string
+	// Verifies the server as this name instead of the host it is dialed by.
+	ServerName string
+	// ie: "1.2" or "1.3".
+	MinVersion string
+}
+
+func DefaultTLSOptions() TLSOptions {
+	return TLSOptions{
+		MinVersion: "1.2",
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config returns the tls.Config of the options, or nil when TLS is not used.
+func (self TLSOptions) Config() (*tls.Config, error) {
+	if !self.Enabled && self.CAPath == "" && self.CertPath == "" && self.KeyPath == "" && self.ServerName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: self.ServerName}
+
+	if self.MinVersion != "" {
+		version, ok := tlsVersions[self.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", self.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if self.CAPath != "" {
+		pem, err := ioutil.ReadFile(self.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", self.CAPath)
+		}
+	}
+
+	if (self.CertPath == "") != (self.KeyPath == "") {
+		return nil, errors.New("a client certificate needs both a cert and a key")
+	}
+	if self.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(self.CertPath, self.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
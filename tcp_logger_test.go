@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -79,3 +90,267 @@ func TestTCPLoggerRetry(t *testing.T) {
 	tcpLogger.Close()
 	server.Close()
 }
+
+// testCerts writes a CA, a server certificate for 127.0.0.1 and a client
+// certificate signed by it into dir.
+func testCerts(t *testing.T, dir string) (caPath string, serverCert tls.Certificate, clientCertPath string, clientKeyPath string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "timber test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func(serial int64, template *x509.Certificate) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = caTemplate.NotBefore
+		template.NotAfter = caTemplate.NotAfter
+		der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+
+	serverCertPEM, serverKeyPEM := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "logstash.test"},
+		DNSNames:    []string{"logstash.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	serverCert, err = tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCertPEM, clientKeyPEM := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "timber"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	caPath = filepath.Join(dir, "ca.pem")
+	clientCertPath = filepath.Join(dir, "client.pem")
+	clientKeyPath = filepath.Join(dir, "client-key.pem")
+	for path, contents := range map[string][]byte{
+		caPath:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		clientCertPath: clientCertPEM,
+		clientKeyPath:  clientKeyPEM,
+	} {
+		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return caPath, serverCert, clientCertPath, clientKeyPath
+}
+
+// acceptLine accepts a connection and reads the first line sent on it, which
+// completes the handshake of a TLS listener.
+func acceptLine(t *testing.T, listener net.Listener) string {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestDialTCPLoggerWithTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath, serverCert, clientCertPath, clientKeyPath := testCerts(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(mustReadFile(t, caPath))
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	options := DefaultTLSOptions()
+	options.CAPath = caPath
+	options.CertPath = clientCertPath
+	options.KeyPath = clientKeyPath
+	options.ServerName = "logstash.test"
+	tlsConfig, err := options.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected minimum TLS version: %x", tlsConfig.MinVersion)
+	}
+
+	accepted := make(chan string, 2)
+	go func() {
+		accepted <- acceptLine(t, listener)
+		accepted <- acceptLine(t, listener)
+	}()
+
+	tcpLogger, err := DialTCPLoggerWithTLS(listener.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLogger.Close()
+
+	tcpLogger.Write([]byte(`{"test": "first"}`))
+	if line := <-accepted; line != "{\"test\": \"first\"}\r\n" {
+		t.Fatalf("Unexpected message over TLS, got:%q", line)
+	}
+
+	// Reconnecting goes through TLS as well.
+	if err := tcpLogger.RetryConnection(); err != nil {
+		t.Fatal(err)
+	}
+	tcpLogger.Write([]byte(`{"test": "second"}`))
+	if line := <-accepted; line != "{\"test\": \"second\"}\r\n" {
+		t.Fatalf("Unexpected message after reconnecting, got:%q", line)
+	}
+}
+
+func TestDialTCPLoggerWithTLS_UnknownCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, serverCert, _, _ := testCerts(t, dir)
+	otherCAPath, _, _, _ := testCerts(t, dir)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	tlsConfig, err := TLSOptions{CAPath: otherCAPath}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that can't be verified is found at startup.
+	_, err = DialTCPLoggerWithTLS(listener.Addr().String(), tlsConfig)
+	if err == nil {
+		t.Fatal("Expected the handshake with an unknown CA to fail")
+	}
+}
+
+func TestDialTCPLoggerWithTLS_UntrustedClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath, serverCert, _, _ := testCerts(t, dir)
+	otherDir := filepath.Join(dir, "other")
+	if err := os.Mkdir(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, _, untrustedCertPath, untrustedKeyPath := testCerts(t, otherDir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(mustReadFile(t, caPath))
+
+	// TLS 1.3 servers check the client certificate after the client is done
+	// with the handshake.
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	options := DefaultTLSOptions()
+	options.CAPath = caPath
+	options.CertPath = untrustedCertPath
+	options.KeyPath = untrustedKeyPath
+	options.ServerName = "logstash.test"
+	tlsConfig, err := options.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected certificate is still found at startup.
+	_, err = DialTCPLoggerWithTLS(listener.Addr().String(), tlsConfig)
+	if err == nil {
+		t.Fatal("Expected the untrusted client certificate to be rejected")
+	}
+}
+
+func TestTLSOptions_Config(t *testing.T) {
+	tlsConfig, err := DefaultTLSOptions().Config()
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("TLS should be off by default, got:%v, %v", tlsConfig, err)
+	}
+
+	tlsConfig, err = TLSOptions{Enabled: true, MinVersion: "1.3"}.Config()
+	if err != nil || tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("Unexpected config: %v, %v", tlsConfig, err)
+	}
+
+	if _, err := (TLSOptions{Enabled: true, MinVersion: "2.0"}).Config(); err == nil {
+		t.Fatal("Expected an unknown TLS version to fail")
+	}
+	if _, err := (TLSOptions{CertPath: "client.pem"}).Config(); err == nil {
+		t.Fatal("Expected a cert without a key to fail")
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
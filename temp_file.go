@@ -0,0 +1,64 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// ie: `temporary file: path "base/pgsql_tmp/pgsql_tmp12345.0", size 1073741824`
+var RegexTempFile = regexp.MustCompile(`^temporary file: path "([^"]*)", size (\d+)`)
+
+// tempFileLogType returns "temp_file" for the entries written by
+// log_temp_files, or an empty string for anything else.
+func tempFileLogType(logLine *PostgresLogLine) string {
+	if RegexTempFile.MatchString(logLine.Message) {
+		return "temp_file"
+	}
+	return ""
+}
+
+type TempFileMessage struct {
+	Path           string `json:"path"`
+	SizeInBytes    int64  `json:"size_in_bytes"`
+	Query          string `json:"query"`
+	Database       string `json:"database"`
+	Username       string `json:"username"`
+	ShardName      string `json:"shard_name"`
+	ShardlessQuery string `json:"shardless_query"`
+	CreatedAt      string `json:"created_at"`
+	Type           string `json:"type"`
+	HostName       string `json:"hostname"`
+	TimberVersion  string `json:"timber_version"`
+
+	*SourceMetadata
+}
+
+// ParseTempFile parses a "temporary file" entry. The query that created the
+// file is in the STATEMENT line that follows it.
+func ParseTempFile(logLine *PostgresLogLine) *TempFileMessage {
+	shardName, shardlessQuery := DerivedValues(logLine.Statement)
+
+	msg := &TempFileMessage{
+		Query:          ScrubQuery(logLine.Statement),
+		Database:       logLine.Database,
+		Username:       logLine.Username,
+		ShardName:      shardName,
+		ShardlessQuery: ScrubQuery(shardlessQuery),
+		CreatedAt:      logLine.CreatedAt(),
+		Type:           "timber.postgres_temp_file",
+		HostName:       logLine.HostName(),
+		TimberVersion:  TimberVersion(),
+		SourceMetadata: logLine.Source,
+	}
+
+	if match := RegexTempFile.FindStringSubmatch(logLine.Message); match != nil {
+		msg.Path = match[1]
+		msg.SizeInBytes, _ = strconv.ParseInt(match[2], 10, 64)
+	}
+
+	return msg
+}
+
+func LogTempFile(logLine *PostgresLogLine, sink Sink) {
+	SendMessage(ParseTempFile(logLine), sink)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingTempFile(t *testing.T) {
+	log := `2021-01-11 15:25:36 EST [56193-3/9939-40] app@ledger LOG:  temporary file: path "base/pgsql_tmp/pgsql_tmp56193.0", size 1073741824
+2021-01-11 15:25:36 EST [56193-3/9939-41] app@ledger STATEMENT:  SELECT * FROM abacus3_qa.transactions WHERE description = 'coffee' ORDER BY amount
+`
+
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	logParser := NewPostgresLogParser(scanner)
+	pgLog, err := logParser.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, "temp_file", pgLog.LogType)
+
+	msg := ParseTempFile(pgLog)
+	assert.Equal(t, "timber.postgres_temp_file", msg.Type)
+	assert.Equal(t, "base/pgsql_tmp/pgsql_tmp56193.0", msg.Path)
+	assert.Equal(t, int64(1073741824), msg.SizeInBytes)
+	assert.Equal(t, "SELECT * FROM abacus3_qa.transactions WHERE description = 'xxx' ORDER BY amount", msg.Query)
+	assert.Equal(t, "SELECT * FROM transactions WHERE description = 'xxx' ORDER BY amount", msg.ShardlessQuery)
+	assert.Equal(t, "abacus3_qa", msg.ShardName)
+	assert.Equal(t, "app", msg.Username)
+}